@@ -1,55 +1,238 @@
 package btree
 
-import "sort"
+import (
+	"cmp"
+	"fmt"
+	"sort"
+)
 
 type Row map[string]any
 
-type Item struct {
-	PK  int
+// ItemOf is one row of a tree keyed by K.
+type ItemOf[K cmp.Ordered] struct {
+	PK  K
 	Row Row
+
+	// Packed holds the row instead of Row when it is set: far smaller for a
+	// tree that keeps many rows in memory. Use Fields to read either form.
+	Packed PackedRow
+
+	// Deleted marks a tombstone: the key was deleted and Row is nil. The tree
+	// stores tombstones like any other item so they can be flushed to disk and
+	// shadow older copies of the key there.
+	Deleted bool
 }
 
-type BTree struct {
-	t    int
-	root *node
-	n    int
+// Fields returns the item's row as a map, unpacking Packed if it is set.
+func (it ItemOf[K]) Fields() Row {
+	if !it.Packed.IsZero() {
+		return it.Packed.Row()
+	}
+	return it.Row
 }
 
-type node struct {
+// BTreeOf is a B-tree of minimum degree t keyed by any ordered type.
+type BTreeOf[K cmp.Ordered] struct {
+	t     int
+	root  *node[K]
+	n     int
+	bytes uint64 // estimated heap held by the items, see Bytes
+
+	// cow marks the nodes this tree owns and may modify in place. Nodes with
+	// another token are shared with a Clone and get copied before any write.
+	cow *cowToken
+}
+
+// cowToken identifies a tree's own nodes. It is not zero-size so every token
+// gets a distinct address.
+type cowToken struct{ _ byte }
+
+// Item, BTree and Iter are the int64-keyed instantiations the engine uses for
+// integer primary keys.
+type (
+	Item  = ItemOf[int64]
+	BTree = BTreeOf[int64]
+	Iter  = IterOf[int64]
+)
+
+type node[K cmp.Ordered] struct {
 	leaf     bool
-	items    []Item
-	children []*node // len(children) = len(items)+1 when non-leaf
+	items    []ItemOf[K]
+	children []*node[K] // len(children) = len(items)+1 when non-leaf
+	cow      *cowToken
+	size     int // items in this subtree, for the order-statistic operations
 }
 
 func New(t int) *BTree {
+	return NewOf[int64](t)
+}
+
+// NewOf returns an empty tree keyed by K.
+func NewOf[K cmp.Ordered](t int) *BTreeOf[K] {
 	if t < 2 {
 		t = 2
 	}
-	return &BTree{
+	cow := &cowToken{}
+	return &BTreeOf[K]{
 		t:    t,
-		root: &node{leaf: true},
+		root: &node[K]{leaf: true, cow: cow},
 		n:    0,
+		cow:  cow,
+	}
+}
+
+// BulkLoad builds a tree from items in strictly ascending PK order. See BulkLoadOf.
+func BulkLoad(t int, next func() (Item, bool)) (*BTree, error) {
+	return BulkLoadOf(t, next)
+}
+
+// BulkLoadOf builds a tree bottom-up from items in strictly ascending PK
+// order, in O(n) and with nodes packed nearly full, instead of splitting its
+// way there one Upsert at a time. next is called until it returns ok=false
+// (IterOf.Next fits). It fails if a key is not greater than the one before.
+func BulkLoadOf[K cmp.Ordered](t int, next func() (ItemOf[K], bool)) (*BTreeOf[K], error) {
+	tr := NewOf[K](t)
+
+	var items []ItemOf[K]
+	for {
+		it, ok := next()
+		if !ok {
+			break
+		}
+		if len(items) > 0 && it.PK <= items[len(items)-1].PK {
+			return nil, fmt.Errorf("bulk load: pk %v after %v: items must be in ascending pk order", it.PK, items[len(items)-1].PK)
+		}
+		items = append(items, it)
+		tr.bytes += itemBytes(it)
+	}
+	if len(items) == 0 {
+		return tr, nil
+	}
+
+	// Each pass turns one level into nodes plus the separators between them,
+	// which become the items of the level above.
+	nodes, seps := tr.packLevel(items, nil)
+	for len(nodes) > 1 {
+		nodes, seps = tr.packLevel(seps, nodes)
+	}
+	tr.root = nodes[0]
+	tr.n = len(items)
+	return tr, nil
+}
+
+// packLevel spreads items over as few nodes as fit, as evenly as possible,
+// keeping one item between each pair of nodes back as a separator. children
+// are the nodes of the level below (nil for leaves); each node takes one more
+// of them than it has items.
+func (tr *BTreeOf[K]) packLevel(items []ItemOf[K], children []*node[K]) ([]*node[K], []ItemOf[K]) {
+	// a node and the separator after it take at most 2t items
+	k := (len(items) + 2*tr.t) / (2 * tr.t)
+	perNode := len(items) - (k - 1)
+	per, extra := perNode/k, perNode%k
+
+	nodes := make([]*node[K], 0, k)
+	seps := make([]ItemOf[K], 0, k-1)
+	pos, child := 0, 0
+	for i := 0; i < k; i++ {
+		n := per
+		if i < extra {
+			n++
+		}
+		// cap each node's slice so appends never spill into its neighbour
+		nd := &node[K]{leaf: children == nil, items: items[pos : pos+n : pos+n], cow: tr.cow, size: n}
+		if children != nil {
+			nd.children = children[child : child+n+1 : child+n+1]
+			for _, c := range nd.children {
+				nd.size += c.size
+			}
+			child += n + 1
+		}
+		nodes = append(nodes, nd)
+		pos += n
+		if i < k-1 {
+			seps = append(seps, items[pos])
+			pos++
+		}
 	}
+	return nodes, seps
+}
+
+// Clone returns a copy of the tree in O(1). The two trees share nodes until
+// one of them writes, which copies just the nodes on that write's path, so
+// either can be changed without the other seeing it.
+//
+// Clone itself writes to tr and must not race with tr's other writers, but
+// afterwards the clone can be read (for example by a flush goroutine) while
+// tr keeps taking writes.
+func (tr *BTreeOf[K]) Clone() *BTreeOf[K] {
+	out := *tr
+	tr.cow = &cowToken{}
+	out.cow = &cowToken{}
+	return &out
+}
+
+// mutable returns n if tr owns it, otherwise a copy of n that tr owns.
+func (tr *BTreeOf[K]) mutable(n *node[K]) *node[K] {
+	if n.cow == tr.cow {
+		return n
+	}
+	c := &node[K]{leaf: n.leaf, cow: tr.cow, size: n.size}
+	c.items = make([]ItemOf[K], len(n.items), cap(n.items))
+	copy(c.items, n.items)
+	if !n.leaf {
+		c.children = make([]*node[K], len(n.children), cap(n.children))
+		copy(c.children, n.children)
+	}
+	return c
+}
+
+// mutableChild makes n.children[i] writable; n must already be.
+func (tr *BTreeOf[K]) mutableChild(n *node[K], i int) *node[K] {
+	c := tr.mutable(n.children[i])
+	n.children[i] = c
+	return c
 }
 
-type Iter struct {
-	stack []iterFrame
+type IterOf[K cmp.Ordered] struct {
+	root  *node[K]
+	stack []iterFrame[K]
+	desc  bool
 }
 
-type iterFrame struct {
-	n *node
+// iterFrame is a node on the iterator's path. Ascending, i is the next item
+// to emit; descending, it is the number of items left to emit, right to left.
+type iterFrame[K cmp.Ordered] struct {
+	n *node[K]
 	i int
 }
 
-func (tr *BTree) IterAscend() *Iter {
-	it := &Iter{}
+func (tr *BTreeOf[K]) IterAscend() *IterOf[K] {
+	it := &IterOf[K]{root: tr.root}
 	it.pushLeft(tr.root)
 	return it
 }
 
-// Next returns the next Item in ascending PK order.
+// IterFrom returns an ascending iterator positioned at the first item with
+// PK >= pk.
+func (tr *BTreeOf[K]) IterFrom(pk K) *IterOf[K] {
+	it := &IterOf[K]{root: tr.root}
+	it.Seek(pk)
+	return it
+}
+
+// IterDescend returns an iterator over all items in descending PK order.
+func (tr *BTreeOf[K]) IterDescend() *IterOf[K] {
+	it := &IterOf[K]{root: tr.root, desc: true}
+	it.pushRight(tr.root)
+	return it
+}
+
+// Next returns the next Item in the iterator's PK order.
 // ok=false when iteration is finished.
-func (it *Iter) Next() (item Item, ok bool) {
+func (it *IterOf[K]) Next() (item ItemOf[K], ok bool) {
+	if it.desc {
+		return it.prev()
+	}
 	for len(it.stack) > 0 {
 		top := &it.stack[len(it.stack)-1]
 		n := top.n
@@ -72,12 +255,74 @@ func (it *Iter) Next() (item Item, ok bool) {
 		// Done with this node
 		it.stack = it.stack[:len(it.stack)-1]
 	}
-	return Item{}, false
+	return ItemOf[K]{}, false
+}
+
+// Seek repositions the iterator in O(log n) so that Next returns the first
+// item with PK >= pk, or for a descending iterator the first with PK <= pk.
+// Like the rest of Iter, it walks the tree as it was when the iterator was
+// created and must not be used across Upserts or Deletes.
+func (it *IterOf[K]) Seek(pk K) {
+	it.stack = it.stack[:0]
+	n := it.root
+	for n != nil {
+		if it.desc {
+			// i = items with PK <= pk, all still to be emitted
+			i := sort.Search(len(n.items), func(i int) bool { return n.items[i].PK > pk })
+			it.stack = append(it.stack, iterFrame[K]{n: n, i: i})
+			if n.leaf || (i > 0 && n.items[i-1].PK == pk) {
+				return
+			}
+			n = n.children[i]
+			continue
+		}
+
+		// i = first item with PK >= pk; child i holds the keys just below it
+		i := sort.Search(len(n.items), func(i int) bool { return n.items[i].PK >= pk })
+		it.stack = append(it.stack, iterFrame[K]{n: n, i: i})
+		if n.leaf || (i < len(n.items) && n.items[i].PK == pk) {
+			return
+		}
+		n = n.children[i]
+	}
+}
+
+// prev is Next for descending iterators: the mirror image of the ascending walk.
+func (it *IterOf[K]) prev() (item ItemOf[K], ok bool) {
+	for len(it.stack) > 0 {
+		top := &it.stack[len(it.stack)-1]
+		n := top.n
+
+		if top.i > 0 {
+			top.i--
+			item = n.items[top.i]
+
+			// After emitting item i, traverse rightmost path of child i (if exists)
+			if !n.leaf {
+				it.pushRight(n.children[top.i])
+			}
+			return item, true
+		}
+
+		// Done with this node
+		it.stack = it.stack[:len(it.stack)-1]
+	}
+	return ItemOf[K]{}, false
+}
+
+func (it *IterOf[K]) pushRight(n *node[K]) {
+	for n != nil {
+		it.stack = append(it.stack, iterFrame[K]{n: n, i: len(n.items)})
+		if n.leaf {
+			return
+		}
+		n = n.children[len(n.children)-1]
+	}
 }
 
-func (it *Iter) pushLeft(n *node) {
+func (it *IterOf[K]) pushLeft(n *node[K]) {
 	for n != nil {
-		it.stack = append(it.stack, iterFrame{n: n, i: 0})
+		it.stack = append(it.stack, iterFrame[K]{n: n, i: 0})
 		if n.leaf {
 			return
 		}
@@ -85,51 +330,75 @@ func (it *Iter) pushLeft(n *node) {
 	}
 }
 
-// Get returns the Row for pk if present.
-func (tr *BTree) Get(pk int) (Row, bool) {
+// Get returns the Row for pk if present. A tombstone counts as absent.
+func (tr *BTreeOf[K]) Get(pk K) (Row, bool) {
+	it, ok := tr.GetItem(pk)
+	if !ok || it.Deleted {
+		return nil, false
+	}
+	return it.Fields(), true
+}
+
+// GetItem returns the Item stored for pk, tombstones included.
+func (tr *BTreeOf[K]) GetItem(pk K) (ItemOf[K], bool) {
 	n := tr.root
 	for {
 		i := sort.Search(len(n.items), func(i int) bool { return n.items[i].PK >= pk })
 		if i < len(n.items) && n.items[i].PK == pk {
-			return n.items[i].Row, true
+			return n.items[i], true
 		}
 		if n.leaf {
-			return nil, false
+			return ItemOf[K]{}, false
 		}
 		n = n.children[i]
 	}
 }
 
 // Upsert inserts item or replaces existing. Returns (old, replaced).
-func (tr *BTree) Upsert(it Item) (Item, bool) {
-	r := tr.root
+func (tr *BTreeOf[K]) Upsert(it ItemOf[K]) (ItemOf[K], bool) {
+	r := tr.mutable(tr.root)
+	tr.root = r
 	if len(r.items) == 2*tr.t-1 {
-		s := &node{leaf: false, children: []*node{r}}
+		s := &node[K]{leaf: false, children: []*node[K]{r}, cow: tr.cow, size: r.size}
 		tr.splitChild(s, 0)
 		tr.root = s
 		old, replaced := tr.insertNonFull(s, it)
-		if !replaced {
-			tr.n++
-		}
+		tr.account(it, old, replaced)
 		return old, replaced
 	}
 
 	old, replaced := tr.insertNonFull(r, it)
-	if !replaced {
-		tr.n++
-	}
+	tr.account(it, old, replaced)
 	return old, replaced
 }
 
-func (tr *BTree) Len() int {
+// account updates Len and Bytes after an Upsert of it that may have replaced old.
+func (tr *BTreeOf[K]) account(it, old ItemOf[K], replaced bool) {
+	tr.bytes += itemBytes(it)
+	if replaced {
+		tr.bytes -= min(tr.bytes, itemBytes(old))
+		return
+	}
+	tr.n++
+}
+
+func (tr *BTreeOf[K]) Len() int {
 	return tr.n
 }
 
-func (tr *BTree) IsEmpty() bool {
+func (tr *BTreeOf[K]) IsEmpty() bool {
 	return tr.n == 0
 }
 
-func (tr *BTree) insertNonFull(n *node, it Item) (Item, bool) {
+// Bytes estimates the heap the tree's items hold: node slots, keys, and each
+// row's map with its field names and values. It is kept up to date by every
+// write, so checking it is O(1). Rows are assumed not to be shared with
+// anything outside the tree, and not to change after they are upserted.
+func (tr *BTreeOf[K]) Bytes() uint64 {
+	return tr.bytes
+}
+
+func (tr *BTreeOf[K]) insertNonFull(n *node[K], it ItemOf[K]) (ItemOf[K], bool) {
 	// Find first index with PK >= it.PK
 	i := sort.Search(len(n.items), func(i int) bool { return n.items[i].PK >= it.PK })
 
@@ -141,10 +410,11 @@ func (tr *BTree) insertNonFull(n *node, it Item) (Item, bool) {
 			return old, true
 		}
 		// Insert into items at i
-		n.items = append(n.items, Item{})
+		n.items = append(n.items, ItemOf[K]{})
 		copy(n.items[i+1:], n.items[i:])
 		n.items[i] = it
-		return Item{}, false
+		n.size++
+		return ItemOf[K]{}, false
 	}
 
 	// Internal node: if key exists in internal node, replace there.
@@ -166,15 +436,19 @@ func (tr *BTree) insertNonFull(n *node, it Item) (Item, bool) {
 			return old, true
 		}
 	}
-	return tr.insertNonFull(n.children[i], it)
+	old, replaced := tr.insertNonFull(tr.mutableChild(n, i), it)
+	if !replaced {
+		n.size++
+	}
+	return old, replaced
 }
 
 // splitChild splits n.children[i] (which must be full) into two nodes and
 // moves the median item up into n.items[i].
-func (tr *BTree) splitChild(n *node, i int) {
+func (tr *BTreeOf[K]) splitChild(n *node[K], i int) {
 	t := tr.t
-	y := n.children[i]       // full child
-	z := &node{leaf: y.leaf} // new node
+	y := tr.mutableChild(n, i)               // full child
+	z := &node[K]{leaf: y.leaf, cow: tr.cow} // new node
 
 	// Median item to move up: y.items[t-1]
 	median := y.items[t-1]
@@ -185,13 +459,18 @@ func (tr *BTree) splitChild(n *node, i int) {
 	y.items = y.items[:t-1]
 
 	// If not leaf, split children too: y has 2t children, keep t, move t to z
+	z.size = len(z.items)
 	if !y.leaf {
 		z.children = append(z.children, y.children[t:]...)
 		y.children = y.children[:t]
+		for _, c := range z.children {
+			z.size += c.size
+		}
 	}
+	y.size -= z.size + 1
 
 	// Insert median into n.items at position i
-	n.items = append(n.items, Item{})
+	n.items = append(n.items, ItemOf[K]{})
 	copy(n.items[i+1:], n.items[i:])
 	n.items[i] = median
 
@@ -201,38 +480,354 @@ func (tr *BTree) splitChild(n *node, i int) {
 	n.children[i+1] = z
 }
 
-// AscendRange calls fn for items with PK in [lo, hi] in sorted order.
+// BoundOf is one end of a key range: a key that is itself in or out of the
+// range, or no limit at all.
+type BoundOf[K cmp.Ordered] struct {
+	Key       K
+	Inclusive bool
+	Unbounded bool
+}
+
+// Bound is the int64-keyed form.
+type Bound = BoundOf[int64]
+
+// Inclusive is a bound that includes k.
+func Inclusive[K cmp.Ordered](k K) BoundOf[K] {
+	return BoundOf[K]{Key: k, Inclusive: true}
+}
+
+// Exclusive is a bound that stops just short of k.
+func Exclusive[K cmp.Ordered](k K) BoundOf[K] {
+	return BoundOf[K]{Key: k}
+}
+
+// Unbounded is a bound that does not limit its end of the range.
+func Unbounded[K cmp.Ordered]() BoundOf[K] {
+	return BoundOf[K]{Unbounded: true}
+}
+
+// below reports whether pk lies past b when b is a lower bound.
+func (b BoundOf[K]) below(pk K) bool {
+	if b.Unbounded {
+		return false
+	}
+	return pk < b.Key || (pk == b.Key && !b.Inclusive)
+}
+
+// above reports whether pk lies past b when b is an upper bound.
+func (b BoundOf[K]) above(pk K) bool {
+	if b.Unbounded {
+		return false
+	}
+	return pk > b.Key || (pk == b.Key && !b.Inclusive)
+}
+
+// AscendRange calls fn for items with lo <= PK < hi in ascending order.
+// If fn returns false, iteration stops early.
+func (tr *BTreeOf[K]) AscendRange(lo, hi K, fn func(ItemOf[K]) bool) {
+	tr.AscendBetween(Inclusive(lo), Exclusive(hi), fn)
+}
+
+// DescendRange calls fn for items with lo <= PK < hi (the same items as
+// AscendRange) in descending order. If fn returns false, iteration stops early.
+func (tr *BTreeOf[K]) DescendRange(hi, lo K, fn func(ItemOf[K]) bool) {
+	tr.DescendBetween(Exclusive(hi), Inclusive(lo), fn)
+}
+
+// AscendBetween calls fn for items between lo and hi in ascending order.
+// If fn returns false, iteration stops early.
+func (tr *BTreeOf[K]) AscendBetween(lo, hi BoundOf[K], fn func(ItemOf[K]) bool) {
+	it := tr.IterAscend()
+	if !lo.Unbounded {
+		it.Seek(lo.Key)
+	}
+	for {
+		item, ok := it.Next()
+		if !ok || hi.above(item.PK) {
+			return
+		}
+		if lo.below(item.PK) {
+			continue // lo itself, excluded
+		}
+		if !fn(item) {
+			return
+		}
+	}
+}
+
+// DescendBetween calls fn for items between lo and hi in descending order.
 // If fn returns false, iteration stops early.
-func (tr *BTree) AscendRange(lo, hi int, fn func(Item) bool) {
-	ascendRangeNode(tr.root, lo, hi, fn)
+func (tr *BTreeOf[K]) DescendBetween(hi, lo BoundOf[K], fn func(ItemOf[K]) bool) {
+	it := tr.IterDescend()
+	if !hi.Unbounded {
+		it.Seek(hi.Key)
+	}
+	for {
+		item, ok := it.Next()
+		if !ok || lo.below(item.PK) {
+			return
+		}
+		if hi.above(item.PK) {
+			continue // hi itself, excluded
+		}
+		if !fn(item) {
+			return
+		}
+	}
 }
 
-func ascendRangeNode(n *node, lo, hi int, fn func(Item) bool) bool {
-	// In-order traversal:
-	// child0, item0, child1, item1, ..., childK
-	for i := 0; i < len(n.items); i++ {
+// Rank returns the number of items with PK < pk, which is pk's position in
+// ascending order if present. Tombstones count as items, as in Len.
+func (tr *BTreeOf[K]) Rank(pk K) int {
+	r, _ := tr.rank(pk)
+	return r
+}
+
+// rank is Rank that also reports whether pk itself is in the tree.
+func (tr *BTreeOf[K]) rank(pk K) (int, bool) {
+	r := 0
+	n := tr.root
+	for {
+		i := sort.Search(len(n.items), func(i int) bool { return n.items[i].PK >= pk })
+		r += i
+		found := i < len(n.items) && n.items[i].PK == pk
 		if !n.leaf {
-			if !ascendRangeNode(n.children[i], lo, hi, fn) {
-				return false
+			// children left of item i hold only smaller keys, and so does
+			// child i when pk sits at item i
+			end := i
+			if found {
+				end = i + 1
 			}
-		}
-		pk := n.items[i].PK
-		if pk >= lo && pk < hi {
-			if !fn(n.items[i]) {
-				return false
+			for _, c := range n.children[:end] {
+				r += c.size
 			}
 		}
-		// small pruning: if pk > hi, we can stop early
-		if pk >= hi {
-			// still need to stop without visiting further children/items
+		if found || n.leaf {
+			return r, found
+		}
+		n = n.children[i]
+	}
+}
+
+// Select returns the item at 0-based position k in ascending PK order.
+// ok=false if k is out of range.
+func (tr *BTreeOf[K]) Select(k int) (item ItemOf[K], ok bool) {
+	if k < 0 || k >= tr.n {
+		return ItemOf[K]{}, false
+	}
+	n := tr.root
+	for {
+		descended := false
+		for i := range n.items {
 			if !n.leaf {
-				return false
+				cs := n.children[i].size
+				if k < cs {
+					n = n.children[i]
+					descended = true
+					break
+				}
+				k -= cs
 			}
-			return false
+			if k == 0 {
+				return n.items[i], true
+			}
+			k--
+		}
+		if !descended {
+			// past every item, so k lies in the last child
+			n = n.children[len(n.items)]
 		}
 	}
-	if !n.leaf {
-		return ascendRangeNode(n.children[len(n.items)], lo, hi, fn)
+}
+
+// CountRange returns the number of items with lo <= PK < hi (the items
+// AscendRange would visit).
+func (tr *BTreeOf[K]) CountRange(lo, hi K) int {
+	return tr.CountBetween(Inclusive(lo), Exclusive(hi))
+}
+
+// CountBetween returns the number of items between lo and hi.
+func (tr *BTreeOf[K]) CountBetween(lo, hi BoundOf[K]) int {
+	start, end := 0, tr.n
+	if !lo.Unbounded {
+		r, found := tr.rank(lo.Key)
+		start = r
+		if found && !lo.Inclusive {
+			start++
+		}
+	}
+	if !hi.Unbounded {
+		r, found := tr.rank(hi.Key)
+		end = r
+		if found && hi.Inclusive {
+			end++
+		}
+	}
+	return max(0, end-start)
+}
+
+// Delete removes the item with pk. Returns (removed, found).
+// To delete a key that may also live in a flushed segment, Upsert a tombstone
+// (Item{PK: pk, Deleted: true}) instead so the deletion reaches disk.
+func (tr *BTreeOf[K]) Delete(pk K) (ItemOf[K], bool) {
+	tr.root = tr.mutable(tr.root)
+	old, found := tr.delete(tr.root, pk)
+	if found {
+		tr.n--
+		tr.bytes -= min(tr.bytes, itemBytes(old))
+	}
+	// The root may have been emptied by a merge of its last two children.
+	if len(tr.root.items) == 0 && !tr.root.leaf {
+		tr.root = tr.root.children[0]
+	}
+	return old, found
+}
+
+// delete removes pk from the subtree rooted at n, which tr must own.
+func (tr *BTreeOf[K]) delete(n *node[K], pk K) (ItemOf[K], bool) {
+	old, found := tr.deleteFrom(n, pk)
+	if found {
+		n.size--
+	}
+	return old, found
+}
+
+// deleteFrom does the work of delete. Every node it descends into is first
+// topped up to at least t items, so removing one never leaves a node below
+// the t-1 minimum and no fix-up pass is needed on the way back.
+func (tr *BTreeOf[K]) deleteFrom(n *node[K], pk K) (ItemOf[K], bool) {
+	t := tr.t
+	i := sort.Search(len(n.items), func(i int) bool { return n.items[i].PK >= pk })
+
+	if i < len(n.items) && n.items[i].PK == pk {
+		old := n.items[i]
+		if n.leaf {
+			n.items = removeItem(n.items, i)
+			return old, true
+		}
+
+		// Internal node: replace with predecessor or successor from a child that
+		// can spare an item, otherwise merge both children around it and recurse.
+		switch {
+		case len(n.children[i].items) >= t:
+			pred := maxItem(n.children[i])
+			n.items[i] = pred
+			tr.delete(tr.mutableChild(n, i), pred.PK)
+		case len(n.children[i+1].items) >= t:
+			succ := minItem(n.children[i+1])
+			n.items[i] = succ
+			tr.delete(tr.mutableChild(n, i+1), succ.PK)
+		default:
+			tr.merge(n, i)
+			tr.delete(n.children[i], pk) // merge made child i writable
+		}
+		return old, true
+	}
+
+	if n.leaf {
+		return ItemOf[K]{}, false
+	}
+
+	// Ensure child i has at least t items before descending.
+	if len(n.children[i].items) == t-1 {
+		switch {
+		case i > 0 && len(n.children[i-1].items) >= t:
+			tr.borrowFromLeft(n, i)
+		case i < len(n.items) && len(n.children[i+1].items) >= t:
+			tr.borrowFromRight(n, i)
+		case i < len(n.items):
+			tr.merge(n, i)
+		default:
+			// last child: merge into its left sibling
+			tr.merge(n, i-1)
+			i--
+		}
+	}
+	return tr.delete(tr.mutableChild(n, i), pk)
+}
+
+// merge folds n.items[i] and n.children[i+1] into n.children[i].
+func (tr *BTreeOf[K]) merge(n *node[K], i int) {
+	y := tr.mutableChild(n, i)
+	z := n.children[i+1] // only read, then dropped
+
+	y.items = append(y.items, n.items[i])
+	y.items = append(y.items, z.items...)
+	y.size += 1 + z.size
+	if !y.leaf {
+		y.children = append(y.children, z.children...)
+	}
+
+	n.items = removeItem(n.items, i)
+	copy(n.children[i+1:], n.children[i+2:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+}
+
+// borrowFromLeft rotates one item from n.children[i-1] through n.items[i-1]
+// into the front of n.children[i].
+func (tr *BTreeOf[K]) borrowFromLeft(n *node[K], i int) {
+	c := tr.mutableChild(n, i)
+	l := tr.mutableChild(n, i-1)
+
+	c.items = append(c.items, ItemOf[K]{})
+	copy(c.items[1:], c.items)
+	c.items[0] = n.items[i-1]
+	n.items[i-1] = l.items[len(l.items)-1]
+	l.items = removeItem(l.items, len(l.items)-1)
+
+	moved := 1
+	if !c.leaf {
+		c.children = append(c.children, nil)
+		copy(c.children[1:], c.children)
+		c.children[0] = l.children[len(l.children)-1]
+		l.children[len(l.children)-1] = nil
+		l.children = l.children[:len(l.children)-1]
+		moved += c.children[0].size
+	}
+	c.size += moved
+	l.size -= moved
+}
+
+// borrowFromRight rotates one item from n.children[i+1] through n.items[i]
+// onto the end of n.children[i].
+func (tr *BTreeOf[K]) borrowFromRight(n *node[K], i int) {
+	c := tr.mutableChild(n, i)
+	r := tr.mutableChild(n, i+1)
+
+	c.items = append(c.items, n.items[i])
+	n.items[i] = r.items[0]
+	r.items = removeItem(r.items, 0)
+
+	moved := 1
+	if !c.leaf {
+		c.children = append(c.children, r.children[0])
+		copy(r.children, r.children[1:])
+		r.children[len(r.children)-1] = nil
+		r.children = r.children[:len(r.children)-1]
+		moved += c.children[len(c.children)-1].size
+	}
+	c.size += moved
+	r.size -= moved
+}
+
+// removeItem deletes items[i], clearing the vacated slot so the Row can be collected.
+func removeItem[K cmp.Ordered](items []ItemOf[K], i int) []ItemOf[K] {
+	copy(items[i:], items[i+1:])
+	items[len(items)-1] = ItemOf[K]{}
+	return items[:len(items)-1]
+}
+
+func minItem[K cmp.Ordered](n *node[K]) ItemOf[K] {
+	for !n.leaf {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func maxItem[K cmp.Ordered](n *node[K]) ItemOf[K] {
+	for !n.leaf {
+		n = n.children[len(n.children)-1]
 	}
-	return true
+	return n.items[len(n.items)-1]
 }
@@ -0,0 +1,638 @@
+package btree
+
+import (
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// collectAscend returns the PKs AscendBetween visits.
+func collectAscend(tr *BTree, lo, hi Bound) []int64 {
+	var pks []int64
+	tr.AscendBetween(lo, hi, func(it Item) bool {
+		pks = append(pks, it.PK)
+		return true
+	})
+	return pks
+}
+
+func collectDescend(tr *BTree, hi, lo Bound) []int64 {
+	var pks []int64
+	tr.DescendBetween(hi, lo, func(it Item) bool {
+		pks = append(pks, it.PK)
+		return true
+	})
+	return pks
+}
+
+// inRange is the reference for bound semantics.
+func inRange(pk int64, lo, hi Bound) bool {
+	if !lo.Unbounded && (pk < lo.Key || (pk == lo.Key && !lo.Inclusive)) {
+		return false
+	}
+	if !hi.Unbounded && (pk > hi.Key || (pk == hi.Key && !hi.Inclusive)) {
+		return false
+	}
+	return true
+}
+
+func expectRange(keys []int64, lo, hi Bound) []int64 {
+	var pks []int64
+	for _, k := range keys {
+		if inRange(k, lo, hi) {
+			pks = append(pks, k)
+		}
+	}
+	return pks
+}
+
+// treeOf builds a degree-t tree holding the even numbers 0..2*(n-1).
+func treeOf(t, n int) *BTree {
+	tr := New(t)
+	for i := 0; i < n; i++ {
+		tr.Upsert(Item{PK: int64(2 * i)})
+	}
+	return tr
+}
+
+func TestAscendBetweenBounds(t *testing.T) {
+	tr := treeOf(2, 10) // 0, 2, ..., 18
+
+	tests := []struct {
+		name   string
+		lo, hi Bound
+		want   []int64
+	}{
+		{"inclusive both", Inclusive[int64](4), Inclusive[int64](8), []int64{4, 6, 8}},
+		{"exclusive both", Exclusive[int64](4), Exclusive[int64](8), []int64{6}},
+		{"half open", Inclusive[int64](4), Exclusive[int64](8), []int64{4, 6}},
+		{"open closed", Exclusive[int64](4), Inclusive[int64](8), []int64{6, 8}},
+		{"bounds between keys", Inclusive[int64](3), Inclusive[int64](9), []int64{4, 6, 8}},
+		{"unbounded low", Unbounded[int64](), Exclusive[int64](6), []int64{0, 2, 4}},
+		{"unbounded high", Exclusive[int64](14), Unbounded[int64](), []int64{16, 18}},
+		{"unbounded both", Unbounded[int64](), Unbounded[int64](), []int64{0, 2, 4, 6, 8, 10, 12, 14, 16, 18}},
+		{"single key", Inclusive[int64](10), Inclusive[int64](10), []int64{10}},
+		{"empty point", Inclusive[int64](10), Exclusive[int64](10), nil},
+		{"inverted", Inclusive[int64](10), Inclusive[int64](4), nil},
+		{"below all", Unbounded[int64](), Exclusive[int64](0), nil},
+		{"above all", Exclusive[int64](18), Unbounded[int64](), nil},
+		{"first and last", Inclusive[int64](0), Inclusive[int64](18), []int64{0, 2, 4, 6, 8, 10, 12, 14, 16, 18}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := collectAscend(tr, tt.lo, tt.hi); !slices.Equal(got, tt.want) {
+				t.Errorf("AscendBetween = %v, want %v", got, tt.want)
+			}
+			want := slices.Clone(tt.want)
+			slices.Reverse(want)
+			if got := collectDescend(tr, tt.hi, tt.lo); !slices.Equal(got, want) {
+				t.Errorf("DescendBetween = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAscendRangeIsHalfOpen(t *testing.T) {
+	tr := treeOf(3, 50)
+
+	var got []int64
+	tr.AscendRange(10, 20, func(it Item) bool {
+		got = append(got, it.PK)
+		return true
+	})
+	if want := []int64{10, 12, 14, 16, 18}; !slices.Equal(got, want) {
+		t.Errorf("AscendRange(10, 20) = %v, want %v", got, want)
+	}
+
+	got = nil
+	tr.DescendRange(20, 10, func(it Item) bool {
+		got = append(got, it.PK)
+		return true
+	})
+	if want := []int64{18, 16, 14, 12, 10}; !slices.Equal(got, want) {
+		t.Errorf("DescendRange(20, 10) = %v, want %v", got, want)
+	}
+}
+
+func TestAscendBetweenStopsEarly(t *testing.T) {
+	tr := treeOf(2, 100)
+
+	var got []int64
+	tr.AscendBetween(Inclusive[int64](50), Unbounded[int64](), func(it Item) bool {
+		got = append(got, it.PK)
+		return len(got) < 3
+	})
+	if want := []int64{50, 52, 54}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got = nil
+	tr.DescendBetween(Inclusive[int64](50), Unbounded[int64](), func(it Item) bool {
+		got = append(got, it.PK)
+		return len(got) < 3
+	})
+	if want := []int64{50, 48, 46}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRangeEmptyTree(t *testing.T) {
+	tr := New(2)
+	if got := collectAscend(tr, Unbounded[int64](), Unbounded[int64]()); got != nil {
+		t.Errorf("AscendBetween on empty tree = %v", got)
+	}
+	if got := collectDescend(tr, Unbounded[int64](), Unbounded[int64]()); got != nil {
+		t.Errorf("DescendBetween on empty tree = %v", got)
+	}
+}
+
+// randomBound picks an inclusive, exclusive or unbounded end near the keys.
+func randomBound(rng *rand.Rand, keySpace int64) Bound {
+	switch rng.Intn(5) {
+	case 0:
+		return Unbounded[int64]()
+	case 1, 2:
+		return Inclusive(rng.Int63n(keySpace+20) - 10)
+	default:
+		return Exclusive(rng.Int63n(keySpace+20) - 10)
+	}
+}
+
+// TestRangeRandomized compares range scans against a sorted slice across tree
+// degrees, sizes (including heavy deletes) and random bounds.
+func TestRangeRandomized(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, degree := range []int{2, 3, 4, 16} {
+		for _, size := range []int{0, 1, 5, 50, 1000} {
+			keySpace := int64(size*3 + 1)
+			tr := New(degree)
+			present := map[int64]bool{}
+			for i := 0; i < size; i++ {
+				pk := rng.Int63n(keySpace)
+				tr.Upsert(Item{PK: pk})
+				present[pk] = true
+			}
+			// delete about a third so the tree has been rebalanced
+			for pk := range present {
+				if rng.Intn(3) == 0 {
+					tr.Delete(pk)
+					delete(present, pk)
+				}
+			}
+			var keys []int64
+			for pk := range present {
+				keys = append(keys, pk)
+			}
+			slices.Sort(keys)
+
+			for q := 0; q < 200; q++ {
+				lo, hi := randomBound(rng, keySpace), randomBound(rng, keySpace)
+				want := expectRange(keys, lo, hi)
+				if got := collectAscend(tr, lo, hi); !slices.Equal(got, want) {
+					t.Fatalf("t=%d n=%d AscendBetween(%+v, %+v) = %v, want %v", degree, size, lo, hi, got, want)
+				}
+				slices.Reverse(want)
+				if got := collectDescend(tr, hi, lo); !slices.Equal(got, want) {
+					t.Fatalf("t=%d n=%d DescendBetween(%+v, %+v) = %v, want %v", degree, size, hi, lo, got, want)
+				}
+			}
+		}
+	}
+}
+
+// keysOf returns every PK in ascending order.
+func keysOf(tr *BTree) []int64 {
+	return collectAscend(tr, Unbounded[int64](), Unbounded[int64]())
+}
+
+// modelKeys returns the sorted keys of a reference map.
+func modelKeys(m map[int64]bool) []int64 {
+	var keys []int64
+	for pk := range m {
+		keys = append(keys, pk)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestCloneIsolatesWrites(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for _, degree := range []int{2, 3, 8} {
+		a := New(degree)
+		ma := map[int64]bool{}
+		for i := 0; i < 2000; i++ {
+			pk := rng.Int63n(3000)
+			a.Upsert(Item{PK: pk, Row: Row{"v": pk}})
+			ma[pk] = true
+		}
+
+		b := a.Clone()
+		mb := map[int64]bool{}
+		for pk := range ma {
+			mb[pk] = true
+		}
+
+		// interleave writes to both trees; each must only see its own
+		for i := 0; i < 3000; i++ {
+			tr, m := a, ma
+			if i%2 == 1 {
+				tr, m = b, mb
+			}
+			pk := rng.Int63n(3000)
+			if rng.Intn(2) == 0 {
+				tr.Upsert(Item{PK: pk, Row: Row{"v": -pk}})
+				m[pk] = true
+			} else {
+				tr.Delete(pk)
+				delete(m, pk)
+			}
+		}
+
+		for _, c := range []struct {
+			name string
+			tr   *BTree
+			m    map[int64]bool
+		}{{"original", a, ma}, {"clone", b, mb}} {
+			if got, want := keysOf(c.tr), modelKeys(c.m); !slices.Equal(got, want) {
+				t.Fatalf("t=%d %s: %d keys, want %d", degree, c.name, len(got), len(want))
+			}
+			if c.tr.Len() != len(c.m) {
+				t.Fatalf("t=%d %s: Len = %d, want %d", degree, c.name, c.tr.Len(), len(c.m))
+			}
+		}
+	}
+}
+
+// TestCloneReadWhileWriting is mostly for -race: a snapshot is iterated on
+// another goroutine while the original keeps taking writes.
+func TestCloneReadWhileWriting(t *testing.T) {
+	tr := treeOf(4, 5000)
+	snap := tr.Clone()
+
+	done := make(chan []int64)
+	go func() {
+		done <- keysOf(snap)
+	}()
+	for i := 0; i < 5000; i++ {
+		tr.Delete(int64(2 * i))
+		tr.Upsert(Item{PK: int64(2*i + 1)})
+	}
+
+	got := <-done
+	if want := keysOf(treeOf(4, 5000)); !slices.Equal(got, want) {
+		t.Fatalf("snapshot changed under writes: %d keys, want %d", len(got), len(want))
+	}
+}
+
+// checkTree verifies B-tree invariants: key order, node fill and leaf depth.
+func checkTree(t *testing.T, tr *BTree) {
+	t.Helper()
+	leafDepth := -1
+	var walk func(n *node[int64], depth int, isRoot bool)
+	walk = func(n *node[int64], depth int, isRoot bool) {
+		if !isRoot && len(n.items) < tr.t-1 {
+			t.Fatalf("node with %d items, min %d", len(n.items), tr.t-1)
+		}
+		if len(n.items) > 2*tr.t-1 {
+			t.Fatalf("node with %d items, max %d", len(n.items), 2*tr.t-1)
+		}
+		size := len(n.items)
+		for _, c := range n.children {
+			size += c.size
+		}
+		if n.size != size {
+			t.Fatalf("node size %d, subtree holds %d", n.size, size)
+		}
+		if n.leaf {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				t.Fatalf("leaves at depths %d and %d", leafDepth, depth)
+			}
+			return
+		}
+		if len(n.children) != len(n.items)+1 {
+			t.Fatalf("%d children for %d items", len(n.children), len(n.items))
+		}
+		for _, c := range n.children {
+			walk(c, depth+1, false)
+		}
+	}
+	walk(tr.root, 0, true)
+
+	keys := keysOf(tr)
+	if !slices.IsSorted(keys) || len(keys) != tr.Len() {
+		t.Fatalf("%d keys in order %v, Len %d", len(keys), slices.IsSorted(keys), tr.Len())
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, degree := range []int{2, 3, 5, 32} {
+		for _, size := range []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 63, 64, 65, 1000, 4097} {
+			src := treeOf(degree, size)
+			tr, err := BulkLoad(degree, src.IterAscend().Next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, tr)
+			if got, want := keysOf(tr), keysOf(src); !slices.Equal(got, want) {
+				t.Fatalf("t=%d n=%d: loaded %d keys, want %d", degree, size, len(got), len(want))
+			}
+
+			// the packed tree must still take writes
+			for i := 0; i < size; i++ {
+				tr.Upsert(Item{PK: int64(2*i + 1)})
+				if i%3 == 0 {
+					tr.Delete(int64(2 * i))
+				}
+			}
+			checkTree(t, tr)
+		}
+	}
+}
+
+func TestBulkLoadRejectsUnsorted(t *testing.T) {
+	pks := []int64{1, 3, 3}
+	i := 0
+	_, err := BulkLoad(2, func() (Item, bool) {
+		if i == len(pks) {
+			return Item{}, false
+		}
+		i++
+		return Item{PK: pks[i-1]}, true
+	})
+	if err == nil {
+		t.Fatal("BulkLoad accepted a repeated key")
+	}
+}
+
+func TestOrderStatistics(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	for _, degree := range []int{2, 3, 8} {
+		tr := New(degree)
+		present := map[int64]bool{}
+		for i := 0; i < 3000; i++ {
+			pk := rng.Int63n(2000)
+			if rng.Intn(4) == 0 {
+				tr.Delete(pk)
+				delete(present, pk)
+			} else {
+				tr.Upsert(Item{PK: pk})
+				present[pk] = true
+			}
+		}
+		// a clone's writes must keep both trees' counts right
+		clone := tr.Clone()
+		for pk := int64(0); pk < 100; pk++ {
+			clone.Delete(pk)
+		}
+		checkTree(t, tr)
+		checkTree(t, clone)
+
+		keys := modelKeys(present)
+		for k, pk := range keys {
+			if got := tr.Rank(pk); got != k {
+				t.Fatalf("t=%d Rank(%d) = %d, want %d", degree, pk, got, k)
+			}
+			if got, ok := tr.Select(k); !ok || got.PK != pk {
+				t.Fatalf("t=%d Select(%d) = %d, %v, want %d", degree, k, got.PK, ok, pk)
+			}
+		}
+		for _, k := range []int{-1, len(keys)} {
+			if _, ok := tr.Select(k); ok {
+				t.Fatalf("t=%d Select(%d) found an item", degree, k)
+			}
+		}
+		if got := tr.Rank(-5); got != 0 {
+			t.Fatalf("Rank below all = %d", got)
+		}
+		if got := tr.Rank(5000); got != len(keys) {
+			t.Fatalf("Rank above all = %d, want %d", got, len(keys))
+		}
+
+		for q := 0; q < 300; q++ {
+			lo, hi := randomBound(rng, 2000), randomBound(rng, 2000)
+			if got, want := tr.CountBetween(lo, hi), len(expectRange(keys, lo, hi)); got != want {
+				t.Fatalf("t=%d CountBetween(%+v, %+v) = %d, want %d", degree, lo, hi, got, want)
+			}
+		}
+		if got, want := tr.CountRange(100, 200), len(expectRange(keys, Inclusive[int64](100), Exclusive[int64](200))); got != want {
+			t.Fatalf("CountRange(100, 200) = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestBytesTracksWrites(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	tr := New(3)
+	rows := map[int64]Row{}
+	for i := 0; i < 3000; i++ {
+		pk := rng.Int63n(1000)
+		if rng.Intn(4) == 0 {
+			tr.Delete(pk)
+			delete(rows, pk)
+			continue
+		}
+		row := Row{"name": strings.Repeat("x", rng.Intn(50)), "n": float64(i)}
+		if rng.Intn(2) == 0 {
+			row["tags"] = []any{"a", "b"}
+		}
+		tr.Upsert(Item{PK: pk, Row: row})
+		rows[pk] = row
+	}
+
+	var want uint64
+	for pk, row := range rows {
+		want += itemBytes(Item{PK: pk, Row: row})
+	}
+	if tr.Bytes() != want {
+		t.Fatalf("Bytes = %d, want %d", tr.Bytes(), want)
+	}
+
+	clone := tr.Clone()
+	clone.Upsert(Item{PK: 5000, Row: Row{"big": strings.Repeat("y", 4096)}})
+	if tr.Bytes() != want || clone.Bytes() <= want+4096 {
+		t.Fatalf("after clone write: tree %d, clone %d, want %d and more", tr.Bytes(), clone.Bytes(), want)
+	}
+
+	loaded, err := BulkLoad(3, tr.IterAscend().Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Bytes() != want {
+		t.Fatalf("BulkLoad Bytes = %d, want %d", loaded.Bytes(), want)
+	}
+
+	for pk := range rows {
+		tr.Delete(pk)
+	}
+	if tr.Bytes() != 0 {
+		t.Fatalf("empty tree Bytes = %d", tr.Bytes())
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for _, degree := range []int{2, 3, 5, 32} {
+		rng := rand.New(rand.NewSource(int64(degree)))
+		tr := New(degree)
+		present := map[int64]bool{}
+		for step := 0; step < 20000; step++ {
+			pk := rng.Int63n(3000)
+			if rng.Intn(3) == 0 {
+				if _, replaced := tr.Upsert(Item{PK: pk, Row: Row{"v": pk}}); replaced != present[pk] {
+					t.Fatalf("t=%d Upsert(%d) replaced=%v, want %v", degree, pk, replaced, present[pk])
+				}
+				present[pk] = true
+				continue
+			}
+			it, ok := tr.Delete(pk)
+			if ok != present[pk] || (ok && (it.PK != pk || it.Row["v"] != pk)) {
+				t.Fatalf("t=%d Delete(%d) = %v, %v, want found=%v", degree, pk, it, ok, present[pk])
+			}
+			delete(present, pk)
+			if _, ok := tr.Get(pk); ok {
+				t.Fatalf("t=%d Get(%d) found a deleted key", degree, pk)
+			}
+			if step%1000 == 0 {
+				checkTree(t, tr)
+			}
+		}
+		checkTree(t, tr)
+		if got, want := keysOf(tr), modelKeys(present); !slices.Equal(got, want) {
+			t.Fatalf("t=%d: %d keys, want %d", degree, len(got), len(want))
+		}
+
+		// drain the tree in random order, down to an empty root
+		for _, pk := range rng.Perm(3000) {
+			tr.Delete(int64(pk))
+		}
+		checkTree(t, tr)
+		if !tr.IsEmpty() || tr.Len() != 0 {
+			t.Fatalf("t=%d: %d keys left after deleting all", degree, tr.Len())
+		}
+		if _, ok := tr.Delete(1); ok {
+			t.Fatalf("t=%d: Delete on an empty tree found a key", degree)
+		}
+		tr.Upsert(Item{PK: 7})
+		if got := keysOf(tr); !slices.Equal(got, []int64{7}) {
+			t.Fatalf("t=%d: emptied tree holds %v after an insert", degree, got)
+		}
+	}
+}
+
+// randomTree fills a degree-t tree with n random keys below keySpace and
+// returns it with its keys in ascending order.
+func randomTree(rng *rand.Rand, t, n int, keySpace int64) (*BTree, []int64) {
+	tr := New(t)
+	present := map[int64]bool{}
+	for i := 0; i < n; i++ {
+		pk := rng.Int63n(keySpace)
+		tr.Upsert(Item{PK: pk})
+		present[pk] = true
+	}
+	return tr, modelKeys(present)
+}
+
+func TestIterDescend(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for _, degree := range []int{2, 3, 8} {
+		for _, size := range []int{0, 1, 40, 2000} {
+			tr, keys := randomTree(rng, degree, size, 5000)
+			var got []int64
+			it := tr.IterDescend()
+			for {
+				item, ok := it.Next()
+				if !ok {
+					break
+				}
+				got = append(got, item.PK)
+			}
+			want := slices.Clone(keys)
+			slices.Reverse(want)
+			if !slices.Equal(got, want) {
+				t.Fatalf("t=%d n=%d: IterDescend gave %d keys, want %d in reverse order", degree, size, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestDescendRange(t *testing.T) {
+	tr := treeOf(2, 10) // 0, 2, ..., 18
+	tests := []struct {
+		hi, lo int64
+		want   []int64
+	}{
+		{10, 4, []int64{8, 6, 4}}, // lo kept, hi left out, as in AscendRange
+		{11, 3, []int64{10, 8, 6, 4}},
+		{100, -5, []int64{18, 16, 14, 12, 10, 8, 6, 4, 2, 0}},
+		{4, 4, nil},
+		{2, 8, nil},
+	}
+	for _, tt := range tests {
+		var got []int64
+		tr.DescendRange(tt.hi, tt.lo, func(it Item) bool {
+			got = append(got, it.PK)
+			return true
+		})
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("DescendRange(%d, %d) = %v, want %v", tt.hi, tt.lo, got, tt.want)
+		}
+	}
+
+	var got []int64
+	tr.DescendRange(100, 0, func(it Item) bool {
+		got = append(got, it.PK)
+		return len(got) < 3
+	})
+	if !slices.Equal(got, []int64{18, 16, 14}) {
+		t.Fatalf("DescendRange stopped after %v, want 3 items", got)
+	}
+}
+
+func TestIterSeek(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	for _, degree := range []int{2, 3, 8} {
+		tr, keys := randomTree(rng, degree, 1500, 4000)
+		asc, desc := tr.IterAscend(), tr.IterDescend()
+		for q := 0; q < 300; q++ {
+			pk := rng.Int63n(4200) - 100
+
+			// IterFrom and a reused iterator's Seek land on the first key >= pk
+			i, _ := slices.BinarySearch(keys, pk)
+			it := tr.IterFrom(pk)
+			if q%2 == 0 {
+				it = asc
+				it.Seek(pk)
+			}
+			for _, want := range keys[i:] {
+				if item, ok := it.Next(); !ok || item.PK != want {
+					t.Fatalf("t=%d: after seeking %d got %v, %v, want %d", degree, pk, item.PK, ok, want)
+				}
+			}
+			if item, ok := it.Next(); ok {
+				t.Fatalf("t=%d: after seeking %d, %d follows the last key", degree, pk, item.PK)
+			}
+
+			// descending, Seek lands on the last key <= pk
+			j, found := slices.BinarySearch(keys, pk)
+			if found {
+				j++
+			}
+			desc.Seek(pk)
+			for k := j - 1; k >= 0; k-- {
+				if item, ok := desc.Next(); !ok || item.PK != keys[k] {
+					t.Fatalf("t=%d: descending after seeking %d got %v, %v, want %d", degree, pk, item.PK, ok, keys[k])
+				}
+			}
+			if item, ok := desc.Next(); ok {
+				t.Fatalf("t=%d: descending after seeking %d, %d follows the first key", degree, pk, item.PK)
+			}
+		}
+	}
+
+	empty := New(2)
+	if _, ok := empty.IterFrom(5).Next(); ok {
+		t.Fatal("IterFrom on an empty tree found an item")
+	}
+}
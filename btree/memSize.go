@@ -0,0 +1,76 @@
+package btree
+
+import (
+	"cmp"
+	"encoding/json"
+	"unsafe"
+)
+
+// Rough 64-bit heap costs, used to estimate how much memory a tree holds.
+// They only need to be close enough for a memory limit to bound the process.
+const (
+	// mapBaseBytes is a map's header plus its first group of slots.
+	mapBaseBytes = 48 + 8*32
+	// mapEntryBytes is one slot (string key header + interface value) at
+	// the map's typical load, plus its control byte.
+	mapEntryBytes = 40
+	// ifaceHeaderBytes is what boxing a string or slice header into an
+	// interface allocates.
+	ifaceHeaderBytes = 16
+	// boxedWordBytes is what boxing a number into an interface allocates.
+	boxedWordBytes = 8
+	// sliceHeaderBytes is a []any header boxed into an interface.
+	sliceHeaderBytes = 24
+)
+
+// itemBytes estimates the heap an item costs while it sits in a tree: its
+// slot in a node (with slack for nodes that are not full), its key and its row,
+// in either form.
+func itemBytes[K cmp.Ordered](it ItemOf[K]) uint64 {
+	slot := uint64(unsafe.Sizeof(it))
+	n := slot + slot/2
+	if s, ok := any(it.PK).(string); ok {
+		n += uint64(len(s))
+	}
+	if it.Row != nil {
+		n += mapBytes(it.Row)
+	}
+	// a packed row is one string; its schema is shared
+	n += uint64(len(it.Packed.data))
+	return n
+}
+
+func mapBytes(m map[string]any) uint64 {
+	n := uint64(mapBaseBytes)
+	for k, v := range m {
+		n += mapEntryBytes + uint64(len(k)) + valueBytes(v)
+	}
+	return n
+}
+
+// valueBytes is the heap a decoded value allocates beyond its interface slot.
+func valueBytes(v any) uint64 {
+	switch x := v.(type) {
+	case nil, bool:
+		return 0
+	case string:
+		return ifaceHeaderBytes + uint64(len(x))
+	case json.Number:
+		return ifaceHeaderBytes + uint64(len(x))
+	case []byte:
+		return sliceHeaderBytes + uint64(cap(x))
+	case []any:
+		n := uint64(sliceHeaderBytes + 16*cap(x))
+		for _, e := range x {
+			n += valueBytes(e)
+		}
+		return n
+	case map[string]any:
+		return mapBytes(x)
+	case Row:
+		return mapBytes(x)
+	default:
+		// numbers and other small scalars
+		return boxedWordBytes
+	}
+}
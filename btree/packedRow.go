@@ -0,0 +1,350 @@
+package btree
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Schema names the columns of packed rows, e.g. from the manifest's RowOrder.
+// Rows store column IDs (positions in the schema) instead of names, so a name
+// is held once per schema rather than once per row.
+//
+// A Schema never changes once made: With returns an extended copy, and rows
+// keep the schema they were packed with. That makes it safe to share between
+// the goroutine filling a tree and one flushing an older tree.
+type Schema struct {
+	names []string
+	ids   map[string]int
+}
+
+// NewSchema returns a schema of the given columns. Repeated names are dropped.
+func NewSchema(columns []string) *Schema {
+	s := &Schema{ids: make(map[string]int, len(columns))}
+	for _, name := range columns {
+		if _, dup := s.ids[name]; !dup {
+			s.ids[name] = len(s.names)
+			s.names = append(s.names, name)
+		}
+	}
+	return s
+}
+
+// Columns returns the column names in ID order. The caller must not modify it.
+func (s *Schema) Columns() []string {
+	return s.names
+}
+
+// Column returns the ID of the named column.
+func (s *Schema) Column(name string) (int, bool) {
+	id, ok := s.ids[name]
+	return id, ok
+}
+
+// With returns s extended by name, or s itself if it already has the column.
+func (s *Schema) With(name string) *Schema {
+	if _, ok := s.ids[name]; ok {
+		return s
+	}
+	return NewSchema(append(slices.Clip(s.names), name))
+}
+
+// Packed value tags. Numbers that fit an int64 are stored as one, whatever
+// type they came in as, the same way the segment writer stores them.
+const (
+	packedNil = iota
+	packedFalse
+	packedTrue
+	packedInt   // zigzag varint
+	packedFloat // f64
+	packedString
+	packedNumber // json.Number text that does not fit an int64
+	packedBytes
+	packedJSON // anything else, as JSON text
+)
+
+// PackedRow is a compact alternative to Row: the fields of one row encoded
+// into a single immutable string against a shared Schema. It costs one
+// allocation per row instead of a map plus a box per value, and nothing for
+// the field names.
+//
+// Layout: [uvarint fieldCount] then per field, in ascending column ID order,
+// [uvarint columnID][u8 tag][value]. Strings, numbers, bytes and JSON values
+// are [uvarint n][n bytes].
+//
+// The zero PackedRow has no fields; ItemOf uses it to mean "the row is in Row".
+type PackedRow struct {
+	schema *Schema
+	data   string
+}
+
+// PackRow encodes the named values against schema, which must have every
+// name. Values can be anything Row holds: nil, bool, numbers, json.Number,
+// strings and []byte are stored natively, anything else as JSON.
+func PackRow(schema *Schema, names []string, vals []any) (PackedRow, error) {
+	if len(names) != len(vals) {
+		return PackedRow{}, fmt.Errorf("%d names for %d values", len(names), len(vals))
+	}
+	ids := make([]int, len(names))
+	for i, name := range names {
+		id, ok := schema.Column(name)
+		if !ok {
+			return PackedRow{}, fmt.Errorf("column %q not in schema", name)
+		}
+		ids[i] = id
+	}
+	// fields usually arrive in schema order already
+	order := make([]int, len(names))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return ids[a] - ids[b] })
+
+	var b strings.Builder
+	var scratch [binary.MaxVarintLen64]byte
+	b.Write(binary.AppendUvarint(scratch[:0], uint64(len(names))))
+	for k, i := range order {
+		if k > 0 && ids[i] == ids[order[k-1]] {
+			return PackedRow{}, fmt.Errorf("column %q given twice", names[i])
+		}
+		b.Write(binary.AppendUvarint(scratch[:0], uint64(ids[i])))
+		if err := appendPacked(&b, vals[i]); err != nil {
+			return PackedRow{}, fmt.Errorf("column %q: %w", names[i], err)
+		}
+	}
+	return PackedRow{schema: schema, data: b.String()}, nil
+}
+
+// PackMap is PackRow for a Row, extending schema by any columns it lacks. It
+// returns the schema the row was packed with.
+func PackMap(schema *Schema, row Row) (PackedRow, *Schema, error) {
+	names := make([]string, 0, len(row))
+	vals := make([]any, 0, len(row))
+	for name, v := range row {
+		schema = schema.With(name)
+		names = append(names, name)
+		vals = append(vals, v)
+	}
+	p, err := PackRow(schema, names, vals)
+	return p, schema, err
+}
+
+func appendPacked(b *strings.Builder, v any) error {
+	var scratch [binary.MaxVarintLen64]byte
+	writeLen := func(tag byte, s string) {
+		b.WriteByte(tag)
+		b.Write(binary.AppendUvarint(scratch[:0], uint64(len(s))))
+		b.WriteString(s)
+	}
+	writeInt := func(i int64) {
+		b.WriteByte(packedInt)
+		b.Write(binary.AppendVarint(scratch[:0], i))
+	}
+
+	switch x := v.(type) {
+	case nil:
+		b.WriteByte(packedNil)
+	case bool:
+		if x {
+			b.WriteByte(packedTrue)
+		} else {
+			b.WriteByte(packedFalse)
+		}
+	case int:
+		writeInt(int64(x))
+	case int8:
+		writeInt(int64(x))
+	case int16:
+		writeInt(int64(x))
+	case int32:
+		writeInt(int64(x))
+	case int64:
+		writeInt(x)
+	case uint:
+		writeInt(int64(x))
+	case uint8:
+		writeInt(int64(x))
+	case uint16:
+		writeInt(int64(x))
+	case uint32:
+		writeInt(int64(x))
+	case uint64:
+		if x > math.MaxInt64 {
+			return fmt.Errorf("uint64 too large for int64: %d", x)
+		}
+		writeInt(int64(x))
+	case float32:
+		b.WriteByte(packedFloat)
+		b.Write(binary.LittleEndian.AppendUint64(scratch[:0], math.Float64bits(float64(x))))
+	case float64:
+		b.WriteByte(packedFloat)
+		b.Write(binary.LittleEndian.AppendUint64(scratch[:0], math.Float64bits(x)))
+	case json.Number:
+		if i64, err := x.Int64(); err == nil {
+			writeInt(i64)
+		} else {
+			writeLen(packedNumber, string(x))
+		}
+	case string:
+		writeLen(packedString, x)
+	case []byte:
+		writeLen(packedBytes, string(x))
+	default:
+		j, err := json.Marshal(x)
+		if err != nil {
+			return fmt.Errorf("unsupported type %T (json marshal failed): %w", v, err)
+		}
+		writeLen(packedJSON, string(j))
+	}
+	return nil
+}
+
+// IsZero reports whether p holds no row at all.
+func (p PackedRow) IsZero() bool {
+	return p.schema == nil
+}
+
+// Schema returns the schema p was packed with.
+func (p PackedRow) Schema() *Schema {
+	return p.schema
+}
+
+// Len returns the number of fields in p.
+func (p PackedRow) Len() int {
+	n, _ := uvarintString(p.data)
+	return int(n)
+}
+
+// Get returns the value of the named field.
+func (p PackedRow) Get(name string) (any, bool) {
+	if p.schema == nil {
+		return nil, false
+	}
+	want, ok := p.schema.Column(name)
+	if !ok {
+		return nil, false
+	}
+	var v any
+	found := false
+	p.scan(func(id int, f packedField) bool {
+		if id == want {
+			v, found = f.value(), true
+		}
+		return id < want
+	})
+	return v, found
+}
+
+// Range calls fn for each field in column order until fn returns false.
+// Strings share p's memory; numbers come back as int64 or float64, other
+// values as readOrderedObject-style JSON (with json.Number).
+func (p PackedRow) Range(fn func(name string, v any) bool) {
+	if p.schema == nil {
+		return
+	}
+	p.scan(func(id int, f packedField) bool {
+		return fn(p.schema.names[id], f.value())
+	})
+}
+
+// Row unpacks p into a map.
+func (p PackedRow) Row() Row {
+	row := make(Row, p.Len())
+	p.Range(func(name string, v any) bool {
+		row[name] = v
+		return true
+	})
+	return row
+}
+
+// scan walks the fields in column order until fn returns false. Values are
+// only decoded if fn asks. p.data comes from PackRow and is trusted.
+func (p PackedRow) scan(fn func(id int, f packedField) bool) {
+	s := p.data
+	count, n := uvarintString(s)
+	s = s[n:]
+	for ; count > 0; count-- {
+		id, n := uvarintString(s)
+		s = s[n:]
+		f := packedField{tag: s[0]}
+		s = s[1:]
+
+		switch f.tag {
+		case packedInt:
+			_, n = uvarintString(s)
+		case packedFloat:
+			n = 8
+		case packedString, packedNumber, packedBytes, packedJSON:
+			size, k := uvarintString(s)
+			s = s[k:]
+			n = int(size)
+		default:
+			n = 0
+		}
+		f.body = s[:n]
+		s = s[n:]
+
+		if !fn(int(id), f) {
+			return
+		}
+	}
+}
+
+// packedField is one encoded value: its tag and the bytes after the tag
+// (without the length prefix, for the variable-size kinds).
+type packedField struct {
+	tag  byte
+	body string
+}
+
+func (f packedField) value() any {
+	switch f.tag {
+	case packedFalse:
+		return false
+	case packedTrue:
+		return true
+	case packedInt:
+		u, _ := uvarintString(f.body)
+		return int64(u>>1) ^ -int64(u&1)
+	case packedFloat:
+		var u uint64
+		for i := 7; i >= 0; i-- {
+			u = u<<8 | uint64(f.body[i])
+		}
+		return math.Float64frombits(u)
+	case packedString:
+		return f.body
+	case packedNumber:
+		return json.Number(f.body)
+	case packedBytes:
+		return []byte(f.body)
+	case packedJSON:
+		dec := json.NewDecoder(strings.NewReader(f.body))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			// PackRow wrote valid JSON, so this cannot happen
+			return json.RawMessage(f.body)
+		}
+		return v
+	default:
+		return nil
+	}
+}
+
+// uvarintString is binary.Uvarint for a string, so reading a PackedRow never
+// copies it.
+func uvarintString(s string) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(s) && i < binary.MaxVarintLen64; i++ {
+		b := s[i]
+		v |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
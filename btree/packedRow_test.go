@@ -0,0 +1,128 @@
+package btree
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPackedRowRoundTrip(t *testing.T) {
+	schema := NewSchema([]string{"name", "count", "active"})
+	names := []string{"active", "name", "count", "score", "big", "raw", "tags", "none"}
+	for _, name := range names {
+		schema = schema.With(name)
+	}
+	vals := []any{
+		true,
+		"héllo",
+		json.Number("-42"),
+		1.5,
+		json.Number("18446744073709551616"),
+		[]byte{0, 1, 2},
+		[]any{"a", json.Number("1")},
+		nil,
+	}
+	p, err := PackRow(schema, names, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Row{
+		"active": true,
+		"name":   "héllo",
+		"count":  int64(-42), // numbers that fit come back as int64, as from a segment
+		"score":  1.5,
+		"big":    json.Number("18446744073709551616"),
+		"raw":    []byte{0, 1, 2},
+		"tags":   []any{"a", json.Number("1")},
+		"none":   nil,
+	}
+	if got := p.Row(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Row() = %#v, want %#v", got, want)
+	}
+	if p.Len() != len(names) {
+		t.Fatalf("Len = %d, want %d", p.Len(), len(names))
+	}
+
+	// fields come back in schema order, not the order they were given in
+	var order []string
+	p.Range(func(name string, _ any) bool {
+		order = append(order, name)
+		return true
+	})
+	if !reflect.DeepEqual(order, schema.Columns()) {
+		t.Fatalf("Range order = %v, want %v", order, schema.Columns())
+	}
+
+	for name, v := range want {
+		if got, ok := p.Get(name); !ok || !reflect.DeepEqual(got, v) {
+			t.Fatalf("Get(%q) = %#v, %v, want %#v", name, got, ok, v)
+		}
+	}
+	if _, ok := p.Get("missing"); ok {
+		t.Fatal("Get found a column not in the schema")
+	}
+}
+
+func TestPackedRowSparseAndErrors(t *testing.T) {
+	schema := NewSchema([]string{"a", "b", "c", "a"})
+	if got := schema.Columns(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("Columns = %v", got)
+	}
+	if schema.With("b") != schema {
+		t.Fatal("With copied a schema that already had the column")
+	}
+	wider := schema.With("d")
+	if _, ok := schema.Column("d"); ok {
+		t.Fatal("With modified the original schema")
+	}
+
+	p, err := PackRow(wider, []string{"d", "b"}, []any{"x", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Get("a"); ok {
+		t.Fatal("Get found a field the row does not have")
+	}
+	if v, ok := p.Get("d"); !ok || v != "x" {
+		t.Fatalf("Get(d) = %v, %v", v, ok)
+	}
+
+	if _, err := PackRow(schema, []string{"d"}, []any{1}); err == nil {
+		t.Fatal("PackRow accepted a column not in the schema")
+	}
+	if _, err := PackRow(schema, []string{"a", "a"}, []any{1, 2}); err == nil {
+		t.Fatal("PackRow accepted a repeated column")
+	}
+
+	var zero ItemOf[int64]
+	if zero.Fields() != nil || !zero.Packed.IsZero() || zero.Packed.Len() != 0 {
+		t.Fatal("zero item has fields")
+	}
+}
+
+func TestPackedRowInTree(t *testing.T) {
+	schema := NewSchema([]string{"name"})
+	tr := New(2)
+	for i := int64(0); i < 100; i++ {
+		p, _, err := PackMap(schema, Row{"name": "row", "n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.Upsert(Item{PK: i, Packed: p})
+	}
+	row, ok := tr.Get(7)
+	if !ok || row["name"] != "row" || row["n"] != int64(7) {
+		t.Fatalf("Get(7) = %v, %v", row, ok)
+	}
+
+	// the packed form must be much smaller than the same rows as maps
+	maps := New(2)
+	tr.AscendRange(0, 100, func(it Item) bool {
+		maps.Upsert(Item{PK: it.PK, Row: it.Fields()})
+		return true
+	})
+	if tr.Bytes()*3 > maps.Bytes() {
+		t.Fatalf("packed rows take %d bytes, maps %d", tr.Bytes(), maps.Bytes())
+	}
+}
@@ -0,0 +1,229 @@
+package btree
+
+import (
+	"cmp"
+	"container/heap"
+	"hash/maphash"
+	"sync"
+)
+
+// shardBatch is how many items a range scan copies out of a shard per lock.
+const shardBatch = 256
+
+// ShardedOf is a goroutine-safe tree made of N B-trees, each behind its own
+// RWMutex. Keys are spread across shards by hash, so writers to different
+// keys rarely contend; range scans merge the shards back into key order.
+type ShardedOf[K cmp.Ordered] struct {
+	seed   maphash.Seed
+	shards []shard[K]
+}
+
+type shard[K cmp.Ordered] struct {
+	mu sync.RWMutex
+	tr *BTreeOf[K]
+}
+
+// Sharded is the int64-keyed form.
+type Sharded = ShardedOf[int64]
+
+// NewSharded returns an empty tree of n shards, each a B-tree of minimum
+// degree t.
+func NewSharded(n, t int) *Sharded {
+	return NewShardedOf[int64](n, t)
+}
+
+// NewShardedOf is NewSharded for any key type.
+func NewShardedOf[K cmp.Ordered](n, t int) *ShardedOf[K] {
+	if n < 1 {
+		n = 1
+	}
+	s := &ShardedOf[K]{seed: maphash.MakeSeed(), shards: make([]shard[K], n)}
+	for i := range s.shards {
+		s.shards[i].tr = NewOf[K](t)
+	}
+	return s
+}
+
+func (s *ShardedOf[K]) shardFor(pk K) *shard[K] {
+	return &s.shards[maphash.Comparable(s.seed, pk)%uint64(len(s.shards))]
+}
+
+// Get returns the Row for pk if present. A tombstone counts as absent.
+func (s *ShardedOf[K]) Get(pk K) (Row, bool) {
+	sh := s.shardFor(pk)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.tr.Get(pk)
+}
+
+// GetItem returns the Item stored for pk, tombstones included.
+func (s *ShardedOf[K]) GetItem(pk K) (ItemOf[K], bool) {
+	sh := s.shardFor(pk)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.tr.GetItem(pk)
+}
+
+// Upsert inserts item or replaces existing. Returns (old, replaced).
+func (s *ShardedOf[K]) Upsert(it ItemOf[K]) (ItemOf[K], bool) {
+	sh := s.shardFor(it.PK)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.tr.Upsert(it)
+}
+
+// Delete removes the item with pk. Returns (removed, found).
+func (s *ShardedOf[K]) Delete(pk K) (ItemOf[K], bool) {
+	sh := s.shardFor(pk)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.tr.Delete(pk)
+}
+
+// Len sums the shard sizes. Under concurrent writes it is only a moment's view.
+func (s *ShardedOf[K]) Len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += sh.tr.Len()
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// Bytes sums the shards' estimated heap use, see BTreeOf.Bytes.
+func (s *ShardedOf[K]) Bytes() uint64 {
+	var n uint64
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += sh.tr.Bytes()
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+func (s *ShardedOf[K]) IsEmpty() bool {
+	return s.Len() == 0
+}
+
+// AscendRange calls fn for items with lo <= PK < hi in ascending order.
+// If fn returns false, iteration stops early.
+func (s *ShardedOf[K]) AscendRange(lo, hi K, fn func(ItemOf[K]) bool) {
+	s.AscendBetween(Inclusive(lo), Exclusive(hi), fn)
+}
+
+// DescendRange calls fn for items with lo <= PK < hi in descending order.
+// If fn returns false, iteration stops early.
+func (s *ShardedOf[K]) DescendRange(hi, lo K, fn func(ItemOf[K]) bool) {
+	s.DescendBetween(Exclusive(hi), Inclusive(lo), fn)
+}
+
+// AscendBetween calls fn for items between lo and hi in ascending order.
+//
+// Shards are read a batch at a time and no lock is held while fn runs, so fn
+// may write to the tree. The scan is not a snapshot: a write that lands while
+// it runs may or may not be seen, but every item fn gets was stored at some
+// point during the scan.
+func (s *ShardedOf[K]) AscendBetween(lo, hi BoundOf[K], fn func(ItemOf[K]) bool) {
+	s.merge(lo, hi, false, fn)
+}
+
+// DescendBetween is AscendBetween in descending order.
+func (s *ShardedOf[K]) DescendBetween(hi, lo BoundOf[K], fn func(ItemOf[K]) bool) {
+	s.merge(lo, hi, true, fn)
+}
+
+// merge k-way merges the shards' slices of the range. A key lives in exactly
+// one shard, so the cursors never tie.
+func (s *ShardedOf[K]) merge(lo, hi BoundOf[K], desc bool, fn func(ItemOf[K]) bool) {
+	h := &cursorHeap[K]{desc: desc}
+	for i := range s.shards {
+		c := &shardCursor[K]{sh: &s.shards[i], lo: lo, hi: hi, desc: desc}
+		if c.fill() {
+			h.cursors = append(h.cursors, c)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		c := h.cursors[0]
+		if !fn(c.buf[c.pos]) {
+			return
+		}
+		c.pos++
+		if c.pos == len(c.buf) && !c.fill() {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+}
+
+// shardCursor walks one shard's part of a range in batches, narrowing its
+// bounds past each batch so the next one resumes where it stopped.
+type shardCursor[K cmp.Ordered] struct {
+	sh     *shard[K]
+	lo, hi BoundOf[K]
+	desc   bool
+	buf    []ItemOf[K]
+	pos    int
+	done   bool
+}
+
+// fill loads the next batch. It returns false once the shard has no more.
+func (c *shardCursor[K]) fill() bool {
+	c.buf, c.pos = c.buf[:0], 0
+	if c.done {
+		return false
+	}
+	collect := func(it ItemOf[K]) bool {
+		c.buf = append(c.buf, it)
+		return len(c.buf) < shardBatch
+	}
+
+	c.sh.mu.RLock()
+	if c.desc {
+		c.sh.tr.DescendBetween(c.hi, c.lo, collect)
+	} else {
+		c.sh.tr.AscendBetween(c.lo, c.hi, collect)
+	}
+	c.sh.mu.RUnlock()
+
+	if len(c.buf) < shardBatch {
+		c.done = true
+	}
+	if len(c.buf) == 0 {
+		return false
+	}
+	last := c.buf[len(c.buf)-1].PK
+	if c.desc {
+		c.hi = Exclusive(last)
+	} else {
+		c.lo = Exclusive(last)
+	}
+	return true
+}
+
+type cursorHeap[K cmp.Ordered] struct {
+	cursors []*shardCursor[K]
+	desc    bool
+}
+
+func (h *cursorHeap[K]) Len() int { return len(h.cursors) }
+func (h *cursorHeap[K]) Less(i, j int) bool {
+	a, b := h.cursors[i].buf[h.cursors[i].pos].PK, h.cursors[j].buf[h.cursors[j].pos].PK
+	if h.desc {
+		return a > b
+	}
+	return a < b
+}
+func (h *cursorHeap[K]) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *cursorHeap[K]) Push(x any)    { h.cursors = append(h.cursors, x.(*shardCursor[K])) }
+func (h *cursorHeap[K]) Pop() any {
+	old := h.cursors
+	x := old[len(old)-1]
+	h.cursors = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,97 @@
+package btree
+
+import (
+	"math/rand"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestShardedRangeMatchesSortedKeys(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	s := NewSharded(8, 2)
+	present := map[int64]bool{}
+	for i := 0; i < 3000; i++ {
+		pk := rng.Int63n(5000)
+		s.Upsert(Item{PK: pk})
+		present[pk] = true
+	}
+	var keys []int64
+	for pk := range present {
+		keys = append(keys, pk)
+	}
+	slices.Sort(keys)
+	if s.Len() != len(keys) {
+		t.Fatalf("Len = %d, want %d", s.Len(), len(keys))
+	}
+
+	for q := 0; q < 100; q++ {
+		lo, hi := randomBound(rng, 5000), randomBound(rng, 5000)
+		want := expectRange(keys, lo, hi)
+
+		var got []int64
+		s.AscendBetween(lo, hi, func(it Item) bool {
+			got = append(got, it.PK)
+			return true
+		})
+		if !slices.Equal(got, want) {
+			t.Fatalf("AscendBetween(%+v, %+v) = %d keys, want %d", lo, hi, len(got), len(want))
+		}
+
+		got = nil
+		s.DescendBetween(hi, lo, func(it Item) bool {
+			got = append(got, it.PK)
+			return true
+		})
+		slices.Reverse(want)
+		if !slices.Equal(got, want) {
+			t.Fatalf("DescendBetween(%+v, %+v) = %d keys, want %d", hi, lo, len(got), len(want))
+		}
+	}
+}
+
+// TestShardedConcurrent is mostly for -race: writers, readers and scans share
+// the tree.
+func TestShardedConcurrent(t *testing.T) {
+	s := NewSharded(4, 3)
+	const writers, perWriter = 4, 2000
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				pk := int64(i*writers + w)
+				s.Upsert(Item{PK: pk, Row: Row{"w": w}})
+				if i%10 == 0 {
+					s.Delete(pk)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				prev := int64(-1)
+				s.AscendRange(0, writers*perWriter, func(it Item) bool {
+					if it.PK <= prev {
+						t.Errorf("scan out of order: %d after %d", it.PK, prev)
+						return false
+					}
+					prev = it.PK
+					return true
+				})
+				s.Get(int64(i))
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := writers * perWriter * 9 / 10
+	if s.Len() != want {
+		t.Fatalf("Len = %d, want %d", s.Len(), want)
+	}
+}
@@ -0,0 +1,586 @@
+package btreeWriting
+
+import (
+	"SpeedyDb/btree"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+// ReaderOf streams length-prefixed records (as produced by WriterOf) back into
+// btree.ItemOf values. Use a large buffer around files for throughput, same as Writer.
+//
+// If the file carries checksums they are verified as records are read; a
+// mismatch is reported as a *CorruptionError.
+type ReaderOf[K Key] struct {
+	br     *bufio.Reader
+	buf    []byte
+	done   bool
+	base   uint64 // file offset of the first byte of br, for error messages
+	end    uint64 // file offset just past the last byte of br; 0 if unknown
+	name   string // file name, for error messages
+	header Header
+	dict   []string // field dictionary (v2+), grows as inline definitions are read
+
+	blockCRC     uint32 // running crc of the current block (ChecksumBlock)
+	blockPending bool   // records read since the last block checksum
+	blockStart   uint64 // file offset of the current block's first record
+
+	// compressed files: the current decompressed frame and read position in it
+	raw    []byte
+	rawPos int
+	stored []byte
+
+	BytesRead uint64
+	Records   uint64
+}
+
+// CorruptionError reports a checksum mismatch or framing damage at a specific
+// byte offset of a file. File is empty if the reader was not given a file.
+type CorruptionError struct {
+	File   string
+	Offset uint64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("corrupt .spdb data at byte %d: %s", e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("%s: corrupt .spdb data at byte %d: %s", e.File, e.Offset, e.Reason)
+}
+
+// NewReader reads and validates the file header, leaving r positioned at the
+// first record.
+func NewReader(r io.Reader) (*Reader, error) {
+	return NewReaderSize(r, 16<<20)
+}
+
+// NewReaderSize is NewReader with an explicit read buffer size, for callers
+// that keep many readers open at once.
+func NewReaderSize(r io.Reader, size int) (*Reader, error) {
+	return NewReaderOf[int64](r, size)
+}
+
+// NewReaderOf is NewReaderSize for any key type. It fails with ErrKeyType if
+// the file's keys are not K.
+func NewReaderOf[K Key](r io.Reader, size int) (*ReaderOf[K], error) {
+	rd := newRecordReader[K](r, size)
+	if named, ok := r.(interface{ Name() string }); ok {
+		rd.name = named.Name()
+	}
+	rd.end = streamSize(r)
+	h, size, err := readHeader(rd.br)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyType[K](h); err != nil {
+		return nil, err
+	}
+	rd.header = h
+	rd.dict = slices.Clip(h.Fields)
+	rd.base = uint64(size)
+	return rd, nil
+}
+
+// newRecordReader reads records from r with no header, for readers that start
+// mid-file (see Segment.ReaderFrom).
+func newRecordReader[K Key](r io.Reader, size int) *ReaderOf[K] {
+	return &ReaderOf[K]{
+		br:  bufio.NewReaderSize(r, size),
+		buf: make([]byte, 0, 64*1024),
+	}
+}
+
+// streamSize returns how many bytes r has left to read, or 0 if it cannot tell.
+func streamSize(r io.Reader) uint64 {
+	switch x := r.(type) {
+	case *os.File:
+		info, err := x.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0
+		}
+		pos, err := x.Seek(0, io.SeekCurrent)
+		if err != nil || pos > info.Size() {
+			return 0
+		}
+		return uint64(info.Size() - pos)
+	case interface{ Len() int }: // bytes.Reader, strings.Reader, bytes.Buffer
+		return uint64(x.Len())
+	}
+	return 0
+}
+
+// fits reports whether n bytes starting at file offset off lie within the
+// data. Lengths read from the file are checked with it before anything is
+// allocated for them, so a damaged length cannot ask for gigabytes.
+func (r *ReaderOf[K]) fits(off, n uint64) bool {
+	return r.end == 0 || off+n <= r.end
+}
+
+func (r *ReaderOf[K]) Header() Header {
+	return r.header
+}
+
+// Next decodes the next record. It returns io.EOF at the end-of-records marker
+// and io.ErrUnexpectedEOF if the stream is cut short. When the reader knows
+// how long its input is, a record whose length prefix points past the end is
+// reported as a *CorruptionError instead, since a cut file and a damaged
+// length look the same.
+func (r *ReaderOf[K]) Next() (btree.ItemOf[K], error) {
+	for {
+		recStart := r.base + r.BytesRead
+		body, blockEnd, err := r.readRecord()
+		if err != nil {
+			return btree.ItemOf[K]{}, err
+		}
+		if blockEnd {
+			continue
+		}
+
+		it, err := r.decodeItem(body)
+		if err != nil {
+			// with block checksums a garbled record usually means a damaged
+			// block, and the checksum error is the more useful report
+			if blockErr := r.FinishBlock(); blockErr != nil {
+				return btree.ItemOf[K]{}, blockErr
+			}
+			return btree.ItemOf[K]{}, r.recordErr(recStart, err)
+		}
+		r.Records++
+		return it, nil
+	}
+}
+
+// FinishBlock reads up to the end of the current block so its checksum gets
+// verified. Call it when stopping mid-block after using rows from that block.
+// It is a no-op unless the file uses ChecksumBlock.
+func (r *ReaderOf[K]) FinishBlock() error {
+	for r.blockPending {
+		_, blockEnd, err := r.readRecord()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if blockEnd {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readRecord reads one frame and verifies its checksum. It returns the record
+// body (valid until the next call), or blockEnd=true after verifying a block
+// checksum.
+func (r *ReaderOf[K]) readRecord() (body []byte, blockEnd bool, err error) {
+	if r.done {
+		return nil, false, io.EOF
+	}
+	if r.header.Compression() != CompressionNone {
+		body, err := r.readFrameRecord()
+		return body, false, err
+	}
+	recStart := r.base + r.BytesRead
+	mode := r.header.Checksum()
+
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r.br, lenBuf[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, r.recordErr(recStart, fmt.Errorf("missing end-of-records marker? %w", err))
+	}
+	recLen := binary.LittleEndian.Uint32(lenBuf[:])
+
+	switch recLen {
+	case 0:
+		// end-of-records marker; the footer follows
+		if r.blockPending {
+			return nil, false, r.corrupt(recStart, "last block has no checksum")
+		}
+		r.done = true
+		r.BytesRead += 4
+		return nil, false, io.EOF
+
+	case blockChecksumMarker:
+		if mode != ChecksumBlock {
+			return nil, false, r.corrupt(recStart, "block checksum marker in a file without block checksums")
+		}
+		var crcBuf [4]byte
+		if _, err := io.ReadFull(r.br, crcBuf[:]); err != nil {
+			return nil, false, r.corrupt(recStart, "block checksum cut short")
+		}
+		if got := binary.LittleEndian.Uint32(crcBuf[:]); got != r.blockCRC {
+			// the damage is somewhere in the block, so point at its start
+			return nil, false, r.corrupt(r.blockStart, fmt.Sprintf("block checksum mismatch for bytes %d-%d (stored %08x, computed %08x)", r.blockStart, recStart-1, got, r.blockCRC))
+		}
+		r.blockCRC = 0
+		r.blockPending = false
+		r.BytesRead += 8
+		return nil, true, nil
+	}
+
+	need := uint64(recLen)
+	if mode == ChecksumRecord {
+		need += 4
+	}
+	if !r.fits(recStart+4, need) {
+		return nil, false, r.corrupt(recStart, fmt.Sprintf("record length %d runs past the end of the data at byte %d", recLen, r.end))
+	}
+	if cap(r.buf) < int(recLen) {
+		r.buf = make([]byte, recLen)
+	}
+	r.buf = r.buf[:recLen]
+	if _, err := io.ReadFull(r.br, r.buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, r.recordErr(recStart, err)
+	}
+	frameLen := uint64(4 + recLen)
+
+	switch mode {
+	case ChecksumRecord:
+		var crcBuf [4]byte
+		if _, err := io.ReadFull(r.br, crcBuf[:]); err != nil {
+			return nil, false, r.corrupt(recStart, "record checksum cut short")
+		}
+		want := crc32.Update(crc32.Update(0, crcTable, lenBuf[:]), crcTable, r.buf)
+		if got := binary.LittleEndian.Uint32(crcBuf[:]); got != want {
+			return nil, false, r.corrupt(recStart, fmt.Sprintf("record checksum mismatch (stored %08x, computed %08x)", got, want))
+		}
+		frameLen += 4
+	case ChecksumBlock:
+		if !r.blockPending {
+			r.blockStart = recStart
+			r.blockPending = true
+		}
+		r.blockCRC = crc32.Update(crc32.Update(r.blockCRC, crcTable, lenBuf[:]), crcTable, r.buf)
+	}
+
+	r.BytesRead += frameLen
+	return r.buf, false, nil
+}
+
+// readFrameRecord returns the next record body from the current compressed
+// frame, loading (and verifying) the next frame when this one is used up.
+func (r *ReaderOf[K]) readFrameRecord() ([]byte, error) {
+	for r.rawPos >= len(r.raw) {
+		end, err := r.loadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			r.done = true
+			return nil, io.EOF
+		}
+	}
+
+	// The frame already passed its checksum (if any), so damage past this
+	// point means a bad writer rather than a bad disk; offsets are frame-relative.
+	frame := r.raw[r.rawPos:]
+	recOff := uint64(r.rawPos)
+	if len(frame) < 4 {
+		return nil, r.corrupt(r.blockStart, fmt.Sprintf("record at frame offset %d cut short", recOff))
+	}
+	recLen := binary.LittleEndian.Uint32(frame[:4])
+	frameLen := 4 + uint64(recLen)
+	if r.header.Checksum() == ChecksumRecord {
+		frameLen += 4
+	}
+	if recLen == 0 || frameLen > uint64(len(frame)) {
+		return nil, r.corrupt(r.blockStart, fmt.Sprintf("record at frame offset %d has bad length %d", recOff, recLen))
+	}
+	body := frame[4 : 4+recLen]
+
+	if r.header.Checksum() == ChecksumRecord {
+		want := crc32.Update(crc32.Update(0, crcTable, frame[:4]), crcTable, body)
+		if got := binary.LittleEndian.Uint32(frame[4+recLen:]); got != want {
+			return nil, r.corrupt(r.blockStart, fmt.Sprintf("record checksum mismatch at frame offset %d (stored %08x, computed %08x)", recOff, got, want))
+		}
+	}
+
+	r.rawPos += int(frameLen)
+	return body, nil
+}
+
+// loadFrame reads and decompresses the next frame. end=true at the end marker.
+func (r *ReaderOf[K]) loadFrame() (end bool, err error) {
+	frameStart := r.base + r.BytesRead
+
+	var hdr [8]byte
+	if _, err := io.ReadFull(r.br, hdr[:4]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, r.recordErr(frameStart, fmt.Errorf("missing end-of-records marker? %w", err))
+	}
+	storedLen := binary.LittleEndian.Uint32(hdr[:4])
+	if storedLen == 0 {
+		r.BytesRead += 4
+		return true, nil
+	}
+	if _, err := io.ReadFull(r.br, hdr[4:]); err != nil {
+		return false, r.corrupt(frameStart, "frame header cut short")
+	}
+	rawLen := binary.LittleEndian.Uint32(hdr[4:])
+	if storedLen > rawLen {
+		return false, r.corrupt(frameStart, fmt.Sprintf("frame stored length %d exceeds raw length %d", storedLen, rawLen))
+	}
+	if !r.fits(frameStart+8, uint64(storedLen)) {
+		return false, r.corrupt(frameStart, fmt.Sprintf("frame length %d runs past the end of the data at byte %d", storedLen, r.end))
+	}
+
+	if cap(r.stored) < int(storedLen) {
+		r.stored = make([]byte, storedLen)
+	}
+	r.stored = r.stored[:storedLen]
+	if _, err := io.ReadFull(r.br, r.stored); err != nil {
+		return false, r.corrupt(frameStart, "frame cut short")
+	}
+	frameLen := uint64(8 + storedLen)
+
+	if r.header.Checksum() == ChecksumBlock {
+		var crcBuf [4]byte
+		if _, err := io.ReadFull(r.br, crcBuf[:]); err != nil {
+			return false, r.corrupt(frameStart, "frame checksum cut short")
+		}
+		want := crc32.Checksum(r.stored, crcTable)
+		if got := binary.LittleEndian.Uint32(crcBuf[:]); got != want {
+			return false, r.corrupt(frameStart, fmt.Sprintf("frame checksum mismatch (stored %08x, computed %08x)", got, want))
+		}
+		frameLen += 4
+	}
+
+	if storedLen == rawLen {
+		// stored uncompressed: swap buffers so the next frame reads into the old raw
+		r.raw, r.stored = r.stored, r.raw
+	} else {
+		raw, err := decompressBlock(r.header.Compression(), r.raw, r.stored, int(rawLen))
+		if err != nil {
+			return false, r.corrupt(frameStart, fmt.Sprintf("decompress frame: %v", err))
+		}
+		r.raw = raw
+	}
+	r.rawPos = 0
+	r.blockStart = frameStart
+	r.BytesRead += frameLen
+	return false, nil
+}
+
+func (r *ReaderOf[K]) corrupt(offset uint64, reason string) error {
+	return &CorruptionError{File: r.name, Offset: offset, Reason: reason}
+}
+
+func (r *ReaderOf[K]) recordErr(offset uint64, err error) error {
+	if r.name == "" {
+		return fmt.Errorf("record at byte %d: %w", offset, err)
+	}
+	return fmt.Errorf("%s: record at byte %d: %w", r.name, offset, err)
+}
+
+func (r *ReaderOf[K]) decodeItem(src []byte) (btree.ItemOf[K], error) {
+	d := decoder{src: src}
+
+	pk := decodeKey[K](&d, r.header.Version)
+	fieldCount := d.u16()
+	if d.err != nil {
+		return btree.ItemOf[K]{}, d.err
+	}
+
+	if fieldCount == tombstoneFieldCount && r.header.Version >= 4 {
+		if len(d.src) != 0 {
+			return btree.ItemOf[K]{}, fmt.Errorf("%d trailing bytes after tombstone", len(d.src))
+		}
+		return btree.ItemOf[K]{PK: pk, Deleted: true}, nil
+	}
+
+	row := make(btree.Row, fieldCount)
+	for i := 0; i < int(fieldCount); i++ {
+		name, err := r.fieldName(&d)
+		if err != nil {
+			return btree.ItemOf[K]{}, fmt.Errorf("field %d name: %w", i, err)
+		}
+		v, err := d.value()
+		if err != nil {
+			return btree.ItemOf[K]{}, fmt.Errorf("field %q: %w", name, err)
+		}
+		row[name] = v
+	}
+
+	if len(d.src) != 0 {
+		return btree.ItemOf[K]{}, fmt.Errorf("%d trailing bytes after %d fields", len(d.src), fieldCount)
+	}
+	return btree.ItemOf[K]{PK: pk, Row: row}, nil
+}
+
+// fieldName reads a field reference: an inline name in v1, a dictionary ID
+// (possibly with its inline definition) in v2.
+func (r *ReaderOf[K]) fieldName(d *decoder) (string, error) {
+	if r.header.Version < 2 {
+		nameLen := d.u8()
+		name := string(d.bytes(int(nameLen)))
+		return name, d.err
+	}
+
+	id := d.u16()
+	if d.err != nil {
+		return "", d.err
+	}
+	if id&fieldDefineBit == 0 {
+		if int(id) >= len(r.dict) {
+			return "", fmt.Errorf("unknown field id %d", id)
+		}
+		return r.dict[id], nil
+	}
+
+	id &^= fieldDefineBit
+	nameLen := d.u8()
+	name := string(d.bytes(int(nameLen)))
+	if d.err != nil {
+		return "", d.err
+	}
+	switch {
+	case int(id) < len(r.dict):
+		// already known, e.g. from the footer when reading from mid-file
+		if r.dict[id] != name {
+			return "", fmt.Errorf("field id %d defined as %q, dictionary has %q", id, name, r.dict[id])
+		}
+		return r.dict[id], nil
+	case int(id) == len(r.dict):
+		r.dict = append(r.dict, name)
+		return name, nil
+	default:
+		return "", fmt.Errorf("field id %d defined before id %d", id, len(r.dict))
+	}
+}
+
+// decoder consumes a record body front to back. The first short read sets err
+// and every later call becomes a no-op, so callers only check err once per step.
+type decoder struct {
+	src []byte
+	err error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.src) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.src[:n]
+	d.src = d.src[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	b := d.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) u16() uint16 {
+	b := d.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (d *decoder) u32() uint32 {
+	b := d.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) u64() uint64 {
+	b := d.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *decoder) value() (any, error) {
+	tag := d.u8()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	switch tag {
+	case tagNil:
+		return nil, nil
+
+	case tagBool:
+		b := d.u8()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return b != 0, nil
+
+	case tagInt64:
+		v := d.u64()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return int64(v), nil
+
+	case tagFloat:
+		v := d.u64()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return math.Float64frombits(v), nil
+
+	case tagString:
+		n := d.u32()
+		s := d.bytes(int(n))
+		if d.err != nil {
+			return nil, d.err
+		}
+		return string(s), nil
+
+	case tagBytes:
+		n := d.u32()
+		b := d.bytes(int(n))
+		if d.err != nil {
+			return nil, d.err
+		}
+		// src is the Reader's reusable buffer, so hand out a copy
+		return append([]byte(nil), b...), nil
+
+	case tagJSON:
+		n := d.u32()
+		b := d.bytes(int(n))
+		if d.err != nil {
+			return nil, d.err
+		}
+		// Decode with UseNumber so values round-trip the same way readOrderedObject produced them.
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("json value: %w", err)
+		}
+		return v, nil
+
+	default:
+		return nil, fmt.Errorf("unknown tag %d", tag)
+	}
+}
@@ -0,0 +1,230 @@
+package btreeWriting
+
+import (
+	"SpeedyDb/btree"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFile writes items to a new file in a temp dir and returns its path.
+func writeFile(t *testing.T, opts WriterOptions, items []btree.Item) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.spdb")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriterWithOptions(f, opts)
+	for _, it := range items {
+		if err := w.WriteItem(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readFile streams every record of path.
+func readFile(t *testing.T, path string) ([]btree.Item, error) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewReaderSize(f, 4096)
+	if err != nil {
+		return nil, err
+	}
+	var items []btree.Item
+	for {
+		it, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return items, nil
+		}
+		if err != nil {
+			return items, err
+		}
+		items = append(items, it)
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	items := []btree.Item{
+		{PK: 1, Row: btree.Row{
+			"nil":    nil,
+			"bool":   true,
+			"int":    int64(-5),
+			"uint":   uint16(7),
+			"float":  1.5,
+			"string": "héllo",
+			"bytes":  []byte{0, 1, 2},
+			"number": json.Number("42"),
+			"big":    json.Number("1e400"),
+			"array":  []any{"x", json.Number("2")},
+			"object": map[string]any{"k": "v"},
+		}},
+		{PK: 2, Row: btree.Row{}},
+		{PK: 3, Row: btree.Row{"string": ""}},
+	}
+	// how each value reads back: integers widen to int64, json.Number that
+	// fits an int64 becomes one and the rest stays text, JSON comes back
+	// decoded with UseNumber
+	want := []btree.Item{
+		{PK: 1, Row: btree.Row{
+			"nil":    nil,
+			"bool":   true,
+			"int":    int64(-5),
+			"uint":   int64(7),
+			"float":  1.5,
+			"string": "héllo",
+			"bytes":  []byte{0, 1, 2},
+			"number": int64(42),
+			"big":    "1e400",
+			"array":  []any{"x", json.Number("2")},
+			"object": map[string]any{"k": "v"},
+		}},
+		{PK: 2, Row: btree.Row{}},
+		{PK: 3, Row: btree.Row{"string": ""}},
+	}
+
+	got, err := readFile(t, writeFile(t, WriterOptions{}, items))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("read back\n%#v\nwant\n%#v", got, want)
+	}
+}
+
+func TestReaderEmptyFile(t *testing.T) {
+	got, err := readFile(t, writeFile(t, WriterOptions{}, nil))
+	if err != nil || len(got) != 0 {
+		t.Fatalf("empty file: %d items, %v", len(got), err)
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	var items []btree.Item
+	for pk := int64(0); pk < 100; pk++ {
+		items = append(items, btree.Item{PK: pk, Row: btree.Row{"v": pk}})
+	}
+	path := writeFile(t, WriterOptions{}, items)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cut := len(b) / 2; cut < len(b)/2+40; cut++ {
+		if err := os.WriteFile(path, b[:cut], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readFile(t, path)
+		// a cut length prefix reads short; a cut body runs past the known size
+		var ce *CorruptionError
+		if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.As(err, &ce) {
+			t.Fatalf("cut at %d: %d items, err %v, want io.ErrUnexpectedEOF or *CorruptionError", cut, len(got), err)
+		}
+		for i, it := range got {
+			if it.PK != int64(i) {
+				t.Fatalf("cut at %d: record %d has pk %d", cut, i, it.PK)
+			}
+		}
+	}
+}
+
+// readErr streams path and returns the first error other than io.EOF.
+func readErr(t *testing.T, path string) error {
+	t.Helper()
+	_, err := readFile(t, path)
+	return err
+}
+
+func TestChecksumsDetectDamage(t *testing.T) {
+	var items []btree.Item
+	for pk := int64(0); pk < 2000; pk++ {
+		items = append(items, btree.Item{PK: pk, Row: btree.Row{"v": pk, "s": "hello world"}})
+	}
+	for _, mode := range []ChecksumMode{ChecksumNone, ChecksumRecord, ChecksumBlock} {
+		path := writeFile(t, WriterOptions{IndexBlockSize: 300, Checksum: mode}, items)
+		got, err := readFile(t, path)
+		if err != nil || len(got) != len(items) {
+			t.Fatalf("mode %d: read %d records, %v", mode, len(got), err)
+		}
+		s, err := OpenSegment(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for pk := int64(-1); pk <= 2000; pk++ {
+			it, ok, err := s.Get(pk)
+			if err != nil || ok != (pk >= 0 && pk < 2000) || (ok && it.Row["v"] != pk) {
+				t.Fatalf("mode %d: Get(%d) = %v, %v, %v", mode, pk, it, ok, err)
+			}
+		}
+		s.Close()
+		if mode == ChecksumNone {
+			continue
+		}
+
+		clean, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range []int{len(clean) / 3, len(clean) / 2, 2 * len(clean) / 3} {
+			b := bytes.Clone(clean)
+			b[off] ^= 0x01
+			if err := os.WriteFile(path, b, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var ce *CorruptionError
+			if err := readErr(t, path); !errors.As(err, &ce) {
+				t.Errorf("mode %d: flipped byte %d: err %v, want *CorruptionError", mode, off, err)
+			} else if ce.Offset > uint64(off) {
+				t.Errorf("mode %d: flipped byte %d reported at %d", mode, off, ce.Offset)
+			}
+		}
+	}
+}
+
+// TestReaderBadRecordLength damages a length prefix so it claims far more
+// bytes than the file has.
+func TestReaderBadRecordLength(t *testing.T) {
+	for _, mode := range []ChecksumMode{ChecksumNone, ChecksumRecord, ChecksumBlock} {
+		path := writeFile(t, WriterOptions{Checksum: mode}, everyThird())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, hdrSize, err := readHeader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.LittleEndian.PutUint32(b[hdrSize:], 0xF0000000)
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		var ce *CorruptionError
+		if err := readErr(t, path); !errors.As(err, &ce) || ce.Offset != uint64(hdrSize) {
+			t.Errorf("mode %d: err %v, want *CorruptionError at byte %d", mode, err, hdrSize)
+		}
+
+		s, err := OpenSegment(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.Get(10); !errors.As(err, &ce) || ce.Offset != uint64(hdrSize) {
+			t.Errorf("mode %d: Get: err %v, want *CorruptionError at byte %d", mode, err, hdrSize)
+		}
+		s.Close()
+	}
+}
@@ -1,4 +1,5 @@
 // Package spdb: fast, buffered, length-prefixed binary writer for btree.Item.
+// Reader (btreeReader.go) decodes the same format back into btree.Item.
 //
 // Best practice here = encode the record into a reusable []byte buffer,
 // then write: [u32 len][record-bytes] in one shot (no "patching" needed).
@@ -6,12 +7,22 @@
 // Record format (little-endian):
 //
 //	[u32 recordLen]
-//	[u32 pk]
-//	[u16 fieldCount]
+//	[pk]                        [i64], or [u16 len][bytes] with FlagStringKeys
+//	[u16 fieldCount]            0xFFFF => tombstone: pk was deleted, no fields follow
 //	repeated fieldCount times:
-//	  [u8 nameLen][name bytes]
+//	  [u16 fieldID]             high bit set => first use of this ID in the file,
+//	    [u8 nameLen][name]      and its name follows
 //	  [u8 tag][value bytes...]
 //
+// Field IDs index the file's field dictionary: the header seeds it (e.g. from
+// Manifest.RowOrder) and names first seen later are defined inline on first
+// use. The footer repeats the full dictionary so readers that seek into the
+// middle of a file can resolve every ID.
+//
+// Older versions, still readable: v1 wrote [u8 nameLen][name] in place of the
+// field ID in every record; v1 and v2 stored every pk as u32; v4 added
+// tombstones and the footer's tombstone count.
+//
 // Tags:
 //
 //	0 nil
@@ -22,19 +33,68 @@
 //	5 bytes       -> [u32 n][n bytes]
 //	6 json        -> [u32 n][n bytes] (fallback)
 //
-// NOTE: Row is a map => field order is NOT deterministic. If you want deterministic
-// field order you must sort keys (costs extra time+memory).
+// File layout:
+//
+//	header:
+//	  ["SPDB"][u16 formatVersion][u16 flags][i64 createdUnixNano]
+//	  [u16 fieldCount] repeated: [u8 nameLen][name]    seed field dictionary
+//	record*            (written in strictly ascending pk order)
+//	[u32 0]            end-of-records marker (a real record is never empty)
+//	footer:
+//	  [u32 indexCount]
+//	  repeated indexCount times:
+//	    [pk firstPK][u64 offset]   first record of each ~IndexBlockSize block
+//	  [u64 recordCount]           tombstones included
+//	  [u64 tombstoneCount]
+//	  [pk minPK][pk maxPK]
+//	  [u16 fieldCount] repeated: [u8 nameLen][name]    full field dictionary
+//	  [u32 crc32c of the footer bytes above]   only if checksums are enabled
+//	trailer (fixed size, last bytes of the file):
+//	  [u64 footerOffset][u32 footerVersion][u32 magic]
+//
+// The sparse index lets a reader binary-search for the block holding a key and
+// seek straight to it instead of decoding the whole file (see Segment).
+//
+// Checksums (CRC32C, header flag says which mode):
+//
+//	ChecksumRecord: every record is followed by [u32 crc] over its len prefix + body.
+//	ChecksumBlock:  every index block ends with [u32 0xFFFFFFFF][u32 crc] over
+//	                all bytes of the block. Cheaper, but a block is only verified
+//	                once it has been read to the end.
+//
+// Compression (codec in the high byte of the header flags): each index block is
+// buffered and written as one frame instead of raw records:
+//
+//	[u32 storedLen][u32 rawLen][storedLen bytes]   storedLen == rawLen => stored raw
+//	[u32 crc32c of the stored bytes]               only with ChecksumBlock
+//
+// The decompressed frame holds ordinary record frames (with record checksums
+// if enabled). Index offsets point at the frame, and the [u32 0] end marker
+// doubles as a frame with storedLen 0.
+//
+// Field order: Row is a map, so by default fields are sorted before encoding
+// (packed rows too, so both forms of a row give the same bytes):
+// dictionary fields by ID (= header seed order, e.g. the manifest's RowOrder or
+// the JSON order of the source rows), then fields new to the file by name.
+// Identical rows written to identically seeded writers give identical bytes;
+// set WriterOptions.CreatedAt as well to make whole files reproducible.
+// WriterOptions.UnorderedFields skips the sort and uses map order.
 package btreeWriting
 
 import (
 	"SpeedyDb/btree"
 	"bufio"
+	"cmp"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"math"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -47,21 +107,188 @@ const (
 	tagJSON   = 6
 )
 
-type Writer struct {
+const (
+	// DefaultIndexBlockSize is how many record bytes go between sparse index entries.
+	DefaultIndexBlockSize = 64 << 10
+
+	// blockChecksumMarker takes the place of a record length to flag a block checksum.
+	blockChecksumMarker = math.MaxUint32
+
+	footerMagic = 0x42445053 // "SPDB" little-endian
+	trailerSize = 16
+
+	// fieldDefineBit marks the first use of a field ID in a file.
+	fieldDefineBit = 1 << 15
+	maxFieldIDs    = fieldDefineBit
+
+	// tombstoneFieldCount in place of a field count marks a deleted pk. A row
+	// can never have that many fields: each needs its own field ID.
+	tombstoneFieldCount = math.MaxUint16
+)
+
+type ChecksumMode uint8
+
+const (
+	ChecksumNone ChecksumMode = iota
+	ChecksumRecord
+	ChecksumBlock
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type WriterOptions struct {
+	// IndexBlockSize is the approximate number of bytes per sparse index block.
+	// 0 means DefaultIndexBlockSize.
+	IndexBlockSize int
+
+	// Checksum selects per-record or per-block CRC32C checksums.
+	Checksum ChecksumMode
+
+	// Compression compresses each index block with the given codec.
+	Compression Compression
+
+	// CreatedAt is stamped into the file header. Zero means time.Now().
+	CreatedAt time.Time
+
+	// Fields seeds the field dictionary in the header, e.g. Manifest.RowOrder.
+	// Other field names still work; they are defined on first use.
+	Fields []string
+
+	// UnorderedFields encodes fields in map iteration order. Slightly faster,
+	// but identical rows no longer produce identical bytes.
+	UnorderedFields bool
+
+	// Sync makes Close fsync the file before closing it, e.g. for a file that
+	// is about to be renamed into place and must be whole on disk first.
+	Sync bool
+}
+
+// IndexEntryOf points at the first record of a block.
+type IndexEntryOf[K Key] struct {
+	FirstPK K
+	Offset  uint64
+}
+
+// IndexEntry, Writer, Reader, Footer and Segment are the int64-keyed forms.
+type (
+	IndexEntry = IndexEntryOf[int64]
+	Writer     = WriterOf[int64]
+	Reader     = ReaderOf[int64]
+	Footer     = FooterOf[int64]
+	Segment    = SegmentOf[int64]
+)
+
+// WriterOf writes a .spdb file of records keyed by K.
+type WriterOf[K Key] struct {
 	f  *os.File
 	bw *bufio.Writer
 
 	BytesWritten uint64
-	Records      uint64
+	Records      uint64 // tombstones included
+	Tombstones   uint64
+
+	blockSize uint64
+	index     []IndexEntryOf[K]
+	minPK     K
+	maxPK     K
+	closed    bool
+	sync      bool
+
+	checksum    ChecksumMode
+	compression Compression
+	blockCRC    uint32 // running crc of the current block (ChecksumBlock, uncompressed)
+	blockBytes  uint64 // record bytes in the current block, before compression
+	block       []byte // current block awaiting compression
+	compressed  []byte // scratch for compressBlock
+
+	itemEncoder[K]
 
 	pool sync.Pool
 }
 
+// itemEncoder encodes record bodies against a field dictionary. Writers and
+// the WAL each keep one per file.
+type itemEncoder[K Key] struct {
+	fieldIDs      map[string]uint16
+	fieldNames    []string
+	pendingFields []string // defined by the record being encoded; committed once it is written
+	unordered     bool
+	fieldOrder    []fieldRef // scratch for sorting a row's fields
+}
+
+// seedFields starts the dictionary with names, as the file header lists them.
+// Names that can never be encoded (too long) and duplicates are left out; an
+// unusable name errors when a row uses it.
+func (e *itemEncoder[K]) seedFields(names []string) {
+	e.fieldIDs = make(map[string]uint16, len(names))
+	e.fieldNames = nil
+	for _, name := range names {
+		if _, dup := e.fieldIDs[name]; dup || len(name) > 255 || len(e.fieldNames) == maxFieldIDs {
+			continue
+		}
+		e.fieldIDs[name] = uint16(len(e.fieldNames))
+		e.fieldNames = append(e.fieldNames, name)
+	}
+}
+
+// commitFields takes the IDs the last encoded record defined inline. Call it
+// once that record is in the file.
+func (e *itemEncoder[K]) commitFields() {
+	for _, name := range e.pendingFields {
+		e.fieldIDs[name] = uint16(len(e.fieldNames))
+		e.fieldNames = append(e.fieldNames, name)
+	}
+	e.pendingFields = e.pendingFields[:0]
+}
+
 // NewWriter wraps an existing *bufio.Writer and uses an internal buffer pool.
 // Use a large bufio.Writer size (e.g. 8–32 MiB) around your file for max throughput.
 func NewWriter(f *os.File) *Writer {
+	return NewWriterWithOptions(f, WriterOptions{})
+}
+
+func NewWriterWithOptions(f *os.File, opts WriterOptions) *Writer {
+	return NewWriterOf[int64](f, opts)
+}
+
+// NewWriterOf is NewWriterWithOptions for any key type.
+func NewWriterOf[K Key](f *os.File, opts WriterOptions) *WriterOf[K] {
+	if opts.IndexBlockSize <= 0 {
+		opts.IndexBlockSize = DefaultIndexBlockSize
+	}
+	if opts.CreatedAt.IsZero() {
+		opts.CreatedAt = time.Now()
+	}
 	bw := bufio.NewWriterSize(f, 16<<20)
-	w := &Writer{f: f, bw: bw}
+	w := &WriterOf[K]{
+		f:           f,
+		bw:          bw,
+		blockSize:   uint64(opts.IndexBlockSize),
+		checksum:    opts.Checksum,
+		compression: opts.Compression,
+		sync:        opts.Sync,
+		itemEncoder: itemEncoder[K]{unordered: opts.UnorderedFields},
+	}
+
+	var flags uint16
+	switch opts.Checksum {
+	case ChecksumRecord:
+		flags |= FlagRecordChecksums
+	case ChecksumBlock:
+		flags |= FlagBlockChecksums
+	}
+	flags |= uint16(opts.Compression) << compressionShift
+	if isStringKey[K]() {
+		flags |= FlagStringKeys
+	}
+
+	w.seedFields(opts.Fields)
+
+	// The header fits in the empty 16 MiB buffer, so this cannot fail here;
+	// a broken file surfaces on the first flush instead.
+	hdr := appendHeader(nil, Header{Version: FormatVersion, Flags: flags, CreatedAt: opts.CreatedAt, Fields: w.fieldNames})
+	_, _ = w.bw.Write(hdr)
+	w.BytesWritten = uint64(len(hdr))
 
 	w.pool.New = func() any {
 		b := make([]byte, 0, 64*1024)
@@ -72,80 +299,320 @@ func NewWriter(f *os.File) *Writer {
 
 // WriteItem encodes and writes one Item as a length-prefixed record.
 // This is the "best practice" fast path: encode into pooled buffer -> write once.
-func (w *Writer) WriteItem(it btree.Item) error {
+func (w *WriterOf[K]) WriteItem(it btree.ItemOf[K]) error {
+	// the sparse index is only searchable if keys are sorted
+	if w.Records > 0 && it.PK <= w.maxPK {
+		return fmt.Errorf("pk %v written after %v: records must be in ascending pk order", it.PK, w.maxPK)
+	}
+
 	bufp := w.pool.Get().(*[]byte)
 	buf := (*bufp)[:0]
 
+	w.pendingFields = w.pendingFields[:0]
 	var err error
-	buf, err = encodeItemInto(buf, it)
-	if err != nil {
-		*bufp = buf
-		w.pool.Put(bufp)
-		return err
+	buf, err = w.encodeItemInto(buf, it)
+	if err == nil {
+		err = w.writeRecord(it.PK, buf)
 	}
+	if err == nil && it.Deleted {
+		w.Tombstones++
+	}
+	if err == nil {
+		// the inline definitions made it to the file, so the IDs are now taken
+		w.commitFields()
+	}
+
+	*bufp = buf
+	w.pool.Put(bufp)
+	return err
+}
 
-	// bytes for this record = 4 (len prefix) + len(buf)
-	recBytes := uint64(4 + len(buf))
+// writeRecord frames one encoded record, starting a new index block first if
+// the current one is full.
+func (w *WriterOf[K]) writeRecord(pk K, body []byte) error {
+	if len(body) >= blockChecksumMarker {
+		return fmt.Errorf("record for pk %v too large (%d bytes)", pk, len(body))
+	}
+
+	if len(w.index) == 0 || w.blockBytes >= w.blockSize {
+		if len(w.index) > 0 {
+			if err := w.endBlock(); err != nil {
+				return err
+			}
+		}
+		w.index = append(w.index, IndexEntryOf[K]{FirstPK: pk, Offset: w.BytesWritten})
+	}
 
-	if err := writeU32ToWriter(w.bw, uint32(len(buf))); err != nil {
-		*bufp = buf
-		w.pool.Put(bufp)
+	var prefix [4]byte
+	binary.LittleEndian.PutUint32(prefix[:], uint32(len(body)))
+	if err := w.emit(prefix[:]); err != nil {
 		return err
 	}
-	if _, err := w.bw.Write(buf); err != nil {
-		*bufp = buf
-		w.pool.Put(bufp)
+	if err := w.emit(body); err != nil {
 		return err
 	}
 
-	w.BytesWritten += recBytes
+	switch w.checksum {
+	case ChecksumRecord:
+		var crc [4]byte
+		binary.LittleEndian.PutUint32(crc[:], crc32.Update(crc32.Update(0, crcTable, prefix[:]), crcTable, body))
+		if err := w.emit(crc[:]); err != nil {
+			return err
+		}
+	case ChecksumBlock:
+		if w.compression == CompressionNone {
+			w.blockCRC = crc32.Update(crc32.Update(w.blockCRC, crcTable, prefix[:]), crcTable, body)
+		}
+	}
+
+	if w.Records == 0 {
+		w.minPK = pk
+	}
+	w.maxPK = pk
 	w.Records++
+	return nil
+}
 
-	*bufp = buf
-	w.pool.Put(bufp)
+// emit adds record bytes to the current block: straight to the file, or to
+// the block buffer when compressing.
+func (w *WriterOf[K]) emit(p []byte) error {
+	w.blockBytes += uint64(len(p))
+	if w.compression != CompressionNone {
+		w.block = append(w.block, p...)
+		return nil
+	}
+	if _, err := w.bw.Write(p); err != nil {
+		return err
+	}
+	w.BytesWritten += uint64(len(p))
 	return nil
 }
 
-func encodeItemInto(dst []byte, it btree.Item) ([]byte, error) {
+func (e *itemEncoder[K]) encodeItemInto(dst []byte, it btree.ItemOf[K]) ([]byte, error) {
 	// pk
-	dst = appendU32(dst, uint32(it.PK))
+	dst, err := appendKey(dst, it.PK)
+	if err != nil {
+		return dst, err
+	}
+
+	if it.Deleted {
+		return appendU16(dst, tombstoneFieldCount), nil
+	}
 
 	// field count
-	if len(it.Row) > math.MaxUint16 {
-		return dst, fmt.Errorf("too many fields: %d", len(it.Row))
+	n := len(it.Row)
+	if !it.Packed.IsZero() {
+		n = it.Packed.Len()
+	}
+	if n >= tombstoneFieldCount {
+		return dst, fmt.Errorf("too many fields: %d", n)
+	}
+	dst = appendU16(dst, uint16(n))
+
+	order := e.fieldOrder[:0]
+	if !it.Packed.IsZero() {
+		it.Packed.Range(func(k string, v any) bool {
+			order = append(order, fieldRef{name: k, val: v})
+			return true
+		})
+	} else {
+		for k, v := range it.Row {
+			order = append(order, fieldRef{name: k, val: v})
+		}
 	}
-	dst = appendU16(dst, uint16(len(it.Row)))
 
-	// fields (map iteration order is random)
-	for k, v := range it.Row {
+	// Known fields by ID, then new ones by name. New IDs are handed out in
+	// that order, so the dictionary itself stays deterministic too. Unordered
+	// writers keep map order, or column order for a packed row.
+	if !e.unordered {
+		for i := range order {
+			order[i].id, order[i].known = e.fieldIDs[order[i].name]
+		}
+		slices.SortFunc(order, compareFieldRefs)
+	}
+
+	for _, f := range order {
+		if dst, err = e.appendField(dst, f.name, f.val); err != nil {
+			break
+		}
+	}
+	// don't keep the row's values alive in the scratch slice
+	clear(order)
+	e.fieldOrder = order[:0]
+	return dst, err
+}
+
+type fieldRef struct {
+	name  string
+	val   any
+	id    uint16
+	known bool
+}
+
+func compareFieldRefs(a, b fieldRef) int {
+	switch {
+	case a.known && b.known:
+		return cmp.Compare(a.id, b.id)
+	case a.known != b.known:
+		if a.known {
+			return -1
+		}
+		return 1
+	default:
+		return strings.Compare(a.name, b.name)
+	}
+}
+
+// appendField encodes one field reference (defining the name inline if it is
+// new to this file) followed by its tagged value.
+func (e *itemEncoder[K]) appendField(dst []byte, k string, v any) ([]byte, error) {
+	if id, ok := e.fieldIDs[k]; ok {
+		dst = appendU16(dst, id)
+	} else {
 		if len(k) > 255 {
 			return dst, fmt.Errorf("field name too long (%d): %q", len(k), k)
 		}
+		id := len(e.fieldNames) + len(e.pendingFields)
+		if id >= maxFieldIDs {
+			return dst, fmt.Errorf("too many distinct field names in one file (max %d)", maxFieldIDs)
+		}
+		e.pendingFields = append(e.pendingFields, k)
+		dst = appendU16(dst, uint16(id)|fieldDefineBit)
 		dst = append(dst, byte(len(k)))
 		dst = append(dst, k...)
-		var err error
-		dst, err = appendAny(dst, v)
-		if err != nil {
-			return dst, fmt.Errorf("field %q: %w", k, err)
-		}
 	}
-
+	dst, err := appendAny(dst, v)
+	if err != nil {
+		return dst, fmt.Errorf("field %q: %w", k, err)
+	}
 	return dst, nil
 }
 
-func (w *Writer) Flush() error {
+func (w *WriterOf[K]) Flush() error {
 	return w.bw.Flush()
 }
 
-func (w *Writer) Close() error {
+// Close writes the end-of-records marker, footer and trailer, then flushes
+// (and with WriterOptions.Sync, fsyncs) and closes the file.
+func (w *WriterOf[K]) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+
+	if err := w.writeFooter(); err != nil {
+		_ = w.f.Close()
+		return err
+	}
 	// flush buffered bytes, then close file
 	if err := w.bw.Flush(); err != nil {
 		_ = w.f.Close()
 		return err
 	}
+	if w.sync {
+		if err := w.f.Sync(); err != nil {
+			_ = w.f.Close()
+			return err
+		}
+	}
 	return w.f.Close()
 }
 
+// endBlock closes the current index block. Compressed blocks are written out
+// as one frame; uncompressed blocks get their checksum with ChecksumBlock and
+// otherwise have no on-disk boundary.
+func (w *WriterOf[K]) endBlock() error {
+	w.blockBytes = 0
+	if w.compression != CompressionNone {
+		return w.writeCompressedBlock()
+	}
+	if w.checksum != ChecksumBlock {
+		return nil
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[0:4], blockChecksumMarker)
+	binary.LittleEndian.PutUint32(b[4:8], w.blockCRC)
+	if _, err := w.bw.Write(b[:]); err != nil {
+		return err
+	}
+	w.BytesWritten += 8
+	w.blockCRC = 0
+	return nil
+}
+
+func (w *WriterOf[K]) writeCompressedBlock() error {
+	raw := w.block
+	stored, err := compressBlock(w.compression, w.compressed, raw)
+	if err != nil {
+		return fmt.Errorf("compress block: %w", err)
+	}
+	if len(stored) >= len(raw) {
+		stored = raw
+	} else {
+		w.compressed = stored
+	}
+
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(stored)))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(len(raw)))
+	if _, err := w.bw.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.bw.Write(stored); err != nil {
+		return err
+	}
+	w.BytesWritten += uint64(8 + len(stored))
+
+	if w.checksum == ChecksumBlock {
+		if err := writeU32ToWriter(w.bw, crc32.Checksum(stored, crcTable)); err != nil {
+			return err
+		}
+		w.BytesWritten += 4
+	}
+
+	w.block = w.block[:0]
+	return nil
+}
+
+func (w *WriterOf[K]) writeFooter() error {
+	if len(w.index) > 0 {
+		if err := w.endBlock(); err != nil {
+			return err
+		}
+	}
+
+	// end-of-records marker
+	if err := writeU32ToWriter(w.bw, 0); err != nil {
+		return err
+	}
+	footerOffset := w.BytesWritten + 4
+
+	buf := make([]byte, 0, 4+len(w.index)*16+32+trailerSize)
+	buf = appendU32(buf, uint32(len(w.index)))
+	for _, e := range w.index {
+		buf, _ = appendKey(buf, e.FirstPK) // checked when the record was written
+		buf = appendU64(buf, e.Offset)
+	}
+	buf = appendU64(buf, w.Records)
+	buf = appendU64(buf, w.Tombstones)
+	buf, _ = appendKey(buf, w.minPK)
+	buf, _ = appendKey(buf, w.maxPK)
+	buf = appendFieldNames(buf, w.fieldNames)
+	if w.checksum != ChecksumNone {
+		buf = appendU32(buf, crc32.Checksum(buf, crcTable))
+	}
+
+	buf = appendU64(buf, footerOffset)
+	buf = appendU32(buf, FormatVersion)
+	buf = appendU32(buf, footerMagic)
+
+	if _, err := w.bw.Write(buf); err != nil {
+		return err
+	}
+	w.BytesWritten += uint64(4 + len(buf))
+	return nil
+}
+
 func appendAny(dst []byte, v any) ([]byte, error) {
 	switch x := v.(type) {
 	case nil:
@@ -271,6 +738,12 @@ func appendU32(dst []byte, v uint32) []byte {
 	return append(dst, b[:]...)
 }
 
+func appendU64(dst []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(dst, b[:]...)
+}
+
 func appendI64(dst []byte, v int64) []byte {
 	var b [8]byte
 	binary.LittleEndian.PutUint64(b[:], uint64(v))
@@ -0,0 +1,156 @@
+package btreeWriting
+
+import (
+	"SpeedyDb/btree"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFieldDictionary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dict.spdb")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriterWithOptions(f, WriterOptions{IndexBlockSize: 100, Fields: []string{"a", "b", "a"}})
+
+	// a row that fails to encode must not use up a dictionary slot
+	if err := w.WriteItem(btree.Item{PK: 1, Row: btree.Row{"bad": make(chan int), "a": 1}}); err == nil {
+		t.Fatal("WriteItem encoded a channel")
+	}
+	for pk := int64(2); pk < 300; pk++ {
+		row := btree.Row{"a": pk, "zz": "x"}
+		if pk%50 == 0 {
+			row[fmt.Sprintf("new%d", pk/50)] = true
+		}
+		if err := w.WriteItem(btree.Item{PK: pk, Row: row}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenSegment(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, want := s.Header().Fields, []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Fatalf("header fields %q, want %q", got, want)
+	}
+	want := []string{"a", "b", "zz", "new1", "new2", "new3", "new4", "new5"}
+	if got := s.Footer().Fields; !slices.Equal(got, want) {
+		t.Fatalf("footer fields %q, want %q", got, want)
+	}
+
+	// rows in late blocks need names defined in earlier ones
+	for pk := int64(2); pk < 300; pk++ {
+		it, ok, err := s.Get(pk)
+		if err != nil || !ok || it.Row["a"] != pk || it.Row["zz"] != "x" {
+			t.Fatalf("Get(%d) = %v, %v, %v", pk, it, ok, err)
+		}
+		if name := fmt.Sprintf("new%d", pk/50); pk%50 == 0 && it.Row[name] != true {
+			t.Fatalf("Get(%d) = %v, missing %s", pk, it.Row, name)
+		}
+	}
+	if got, err := readFile(t, path); err != nil || len(got) != 298 {
+		t.Fatalf("read %d records, %v", len(got), err)
+	}
+
+	// a name is spelled out once inline and once in the footer, not per row
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("zz")); n != 2 {
+		t.Fatalf("field name stored %d times", n)
+	}
+	if bytes.Contains(b, []byte("bad")) {
+		t.Fatal("the failed row's field name reached the file")
+	}
+}
+
+func TestWriterIsDeterministic(t *testing.T) {
+	write := func(opts WriterOptions) []byte {
+		var items []btree.Item
+		for pk := int64(0); pk < 200; pk++ {
+			// new maps each time, so Go hands out a new iteration order
+			items = append(items, btree.Item{PK: pk, Row: btree.Row{
+				"name": "x", "ts": pk, "zeta": 1, "alpha": 2, "mid": pk % 3,
+				"nested": map[string]any{"b": 1, "a": 2},
+			}})
+		}
+		b, err := os.ReadFile(writeFile(t, opts, items))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	opts := WriterOptions{CreatedAt: time.Unix(5, 0), Fields: []string{"ts", "name"}}
+	first := write(opts)
+	for i := 0; i < 5; i++ {
+		if !bytes.Equal(write(opts), first) {
+			t.Fatal("the same rows encoded to different bytes")
+		}
+	}
+
+	// seeded fields keep their IDs; the rest are numbered by name
+	s, err := OpenSegment(writeFile(t, opts, []btree.Item{{PK: 1, Row: btree.Row{"zeta": 1, "alpha": 2, "name": "x"}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, want := s.Footer().Fields, []string{"ts", "name", "alpha", "zeta"}; !slices.Equal(got, want) {
+		t.Fatalf("footer fields %q, want %q", got, want)
+	}
+
+	opts.UnorderedFields = true
+	got, err := readFile(t, writeFile(t, opts, []btree.Item{{PK: 1, Row: btree.Row{"zeta": 1, "alpha": 2}}}))
+	if err != nil || len(got) != 1 || got[0].Row["zeta"] != int64(1) || got[0].Row["alpha"] != int64(2) {
+		t.Fatalf("unordered file read back as %v, %v", got, err)
+	}
+}
+
+func TestWriterPackedRows(t *testing.T) {
+	rows := []btree.Row{
+		{"name": "a", "n": json.Number("3"), "f": 1.25, "o": map[string]any{"x": json.Number("1")}},
+		{"zz": true, "name": "b"},
+		{},
+	}
+	write := func(packed bool) []byte {
+		opts := WriterOptions{Fields: []string{"name", "n"}, CreatedAt: time.Unix(1, 0)}
+		schema := btree.NewSchema(opts.Fields)
+		var items []btree.Item
+		for i, row := range rows {
+			it := btree.Item{PK: int64(i), Row: row}
+			if packed {
+				p, s, err := btree.PackMap(schema, row)
+				if err != nil {
+					t.Fatal(err)
+				}
+				schema = s
+				it = btree.Item{PK: int64(i), Packed: p}
+			}
+			items = append(items, it)
+		}
+		items = append(items, btree.Item{PK: 9, Deleted: true})
+		b, err := os.ReadFile(writeFile(t, opts, items))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// a packed row is written exactly as the map it was packed from
+	if maps, packed := write(false), write(true); !bytes.Equal(maps, packed) {
+		t.Fatalf("packed rows and maps wrote different files (%d and %d bytes)", len(packed), len(maps))
+	}
+}
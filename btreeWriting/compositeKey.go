@@ -0,0 +1,90 @@
+package btreeWriting
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Composite keys pack several primary key columns into one string key whose
+// bytewise order is the column-by-column order, so they sort correctly as
+// string keys in the tree, in file names and in range scans. Each part is a
+// tag byte followed by:
+//
+//	int64:  8 bytes big-endian with the sign bit flipped
+//	string: the bytes with 0x00 escaped as 0x00 0xFF, ended by 0x00 0x01
+//
+// Within one column ints sort before strings.
+const (
+	compositeInt    byte = 0x01
+	compositeString byte = 0x02
+
+	compositeEscape byte = 0xFF
+	compositeEnd    byte = 0x01
+)
+
+var errCompositeKey = errors.New("malformed composite key")
+
+// AppendCompositeInt appends an int64 key part.
+func AppendCompositeInt(dst []byte, v int64) []byte {
+	dst = append(dst, compositeInt)
+	return binary.BigEndian.AppendUint64(dst, uint64(v)^(1<<63))
+}
+
+// AppendCompositeString appends a string key part.
+func AppendCompositeString(dst []byte, s string) []byte {
+	dst = append(dst, compositeString)
+	for {
+		i := strings.IndexByte(s, 0)
+		if i < 0 {
+			break
+		}
+		dst = append(dst, s[:i]...)
+		dst = append(dst, 0, compositeEscape)
+		s = s[i+1:]
+	}
+	dst = append(dst, s...)
+	return append(dst, 0, compositeEnd)
+}
+
+// DecodeCompositeKey splits a composite key back into its int64 and string parts.
+func DecodeCompositeKey(k string) ([]any, error) {
+	var parts []any
+	for len(k) > 0 {
+		tag := k[0]
+		k = k[1:]
+		switch tag {
+		case compositeInt:
+			if len(k) < 8 {
+				return nil, errCompositeKey
+			}
+			parts = append(parts, int64(binary.BigEndian.Uint64([]byte(k[:8]))^(1<<63)))
+			k = k[8:]
+
+		case compositeString:
+			var b strings.Builder
+			for {
+				i := strings.IndexByte(k, 0)
+				if i < 0 || i+1 >= len(k) {
+					return nil, errCompositeKey
+				}
+				b.WriteString(k[:i])
+				esc := k[i+1]
+				k = k[i+2:]
+				if esc == compositeEnd {
+					break
+				}
+				if esc != compositeEscape {
+					return nil, errCompositeKey
+				}
+				b.WriteByte(0)
+			}
+			parts = append(parts, b.String())
+
+		default:
+			return nil, fmt.Errorf("%w: unknown part tag 0x%02x", errCompositeKey, tag)
+		}
+	}
+	return parts, nil
+}
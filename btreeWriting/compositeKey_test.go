@@ -0,0 +1,48 @@
+package btreeWriting
+
+import (
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompositeKeyOrder(t *testing.T) {
+	type key struct {
+		a int64
+		b string
+	}
+	in := []key{
+		{-5, "x"}, {math.MinInt64, ""}, {3, "a\x00b"}, {3, "a"}, {3, "a\x00"},
+		{3, "ab"}, {math.MaxInt64, "z"}, {0, "\xff"}, {0, ""},
+	}
+	enc := func(k key) string {
+		return string(AppendCompositeString(AppendCompositeInt(nil, k.a), k.b))
+	}
+
+	// encoded keys sort the way their parts do, column by column
+	sorted := slices.Clone(in)
+	slices.SortFunc(sorted, func(x, y key) int { return strings.Compare(enc(x), enc(y)) })
+	for i := 1; i < len(sorted); i++ {
+		p, q := sorted[i-1], sorted[i]
+		if p.a > q.a || (p.a == q.a && p.b >= q.b) {
+			t.Fatalf("%v sorts before %v", p, q)
+		}
+	}
+
+	for _, k := range in {
+		got, err := DecodeCompositeKey(enc(k))
+		if err != nil || !reflect.DeepEqual(got, []any{k.a, k.b}) {
+			t.Fatalf("DecodeCompositeKey(%v) = %v, %v", k, got, err)
+		}
+	}
+}
+
+func TestDecodeCompositeKeyRejects(t *testing.T) {
+	for _, k := range []string{"\x01abc", "\x02abc", "\x02a\x00", "\x02a\x00\x05", "\x07"} {
+		if parts, err := DecodeCompositeKey(k); err == nil {
+			t.Errorf("DecodeCompositeKey(%q) = %v", k, parts)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package btreeWriting
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression is the block codec. It is stored in the high byte of the header flags.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+	CompressionLZ4
+
+	maxCompression = CompressionLZ4
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionLZ4:
+		return "lz4"
+	default:
+		return fmt.Sprintf("Compression(%d)", uint8(c))
+	}
+}
+
+// ParseCompression maps a codec name (as printed by String) to a Compression.
+func ParseCompression(name string) (Compression, error) {
+	for c := CompressionNone; c <= maxCompression; c++ {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %q (want none, snappy, zstd or lz4)", name)
+}
+
+// The zstd encoder/decoder are expensive to build but safe for concurrent
+// EncodeAll/DecodeAll, so every Writer and Reader shares one of each.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	})
+)
+
+// compressBlock appends the compressed form of src to dst[:0]. If the codec
+// does not shrink the block the caller stores it raw instead.
+func compressBlock(c Compression, dst, src []byte) ([]byte, error) {
+	switch c {
+	case CompressionSnappy:
+		return snappy.Encode(dst[:cap(dst)], src), nil
+
+	case CompressionZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(src, dst[:0]), nil
+
+	case CompressionLZ4:
+		bound := lz4.CompressBlockBound(len(src))
+		if cap(dst) < bound {
+			dst = make([]byte, bound)
+		}
+		n, err := lz4.CompressBlock(src, dst[:bound], nil)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			// incompressible: make the caller store it raw
+			return src, nil
+		}
+		return dst[:n], nil
+
+	default:
+		return nil, fmt.Errorf("unsupported compression %v", c)
+	}
+}
+
+// decompressBlock decodes src into dst[:0], which must decode to exactly rawLen bytes.
+func decompressBlock(c Compression, dst, src []byte, rawLen int) ([]byte, error) {
+	if cap(dst) < rawLen {
+		dst = make([]byte, rawLen)
+	}
+	dst = dst[:rawLen]
+
+	var out []byte
+	var err error
+	switch c {
+	case CompressionSnappy:
+		out, err = snappy.Decode(dst, src)
+
+	case CompressionZstd:
+		var dec *zstd.Decoder
+		dec, err = zstdDecoder()
+		if err == nil {
+			out, err = dec.DecodeAll(src, dst[:0])
+		}
+
+	case CompressionLZ4:
+		var n int
+		n, err = lz4.UncompressBlock(src, dst)
+		out = dst[:n]
+
+	default:
+		return nil, fmt.Errorf("unsupported compression %v", c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != rawLen {
+		return nil, fmt.Errorf("%v block decoded to %d bytes, want %d", c, len(out), rawLen)
+	}
+	return out, nil
+}
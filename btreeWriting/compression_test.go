@@ -0,0 +1,112 @@
+package btreeWriting
+
+import (
+	"SpeedyDb/btree"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	for c := CompressionNone; c <= maxCompression; c++ {
+		got, err := ParseCompression(c.String())
+		if err != nil || got != c {
+			t.Errorf("ParseCompression(%q) = %v, %v", c.String(), got, err)
+		}
+	}
+	if _, err := ParseCompression("gzip"); err == nil {
+		t.Error("ParseCompression accepted gzip")
+	}
+}
+
+// compressibleItems returns rows with plenty of repetition between them.
+func compressibleItems() []btree.Item {
+	var items []btree.Item
+	for pk := int64(0); pk < 5000; pk++ {
+		items = append(items, btree.Item{PK: pk, Row: btree.Row{
+			"n":    pk,
+			"tags": []any{"alpha", "bravo"},
+			"name": fmt.Sprintf("kilo_%d", pk%100),
+		}})
+	}
+	return items
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	items := compressibleItems()
+	var plainSize int64
+	for c := CompressionNone; c <= maxCompression; c++ {
+		for _, mode := range []ChecksumMode{ChecksumNone, ChecksumRecord, ChecksumBlock} {
+			path := writeFile(t, WriterOptions{IndexBlockSize: 4096, Checksum: mode, Compression: c}, items)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c == CompressionNone && mode == ChecksumNone {
+				plainSize = info.Size()
+			} else if c != CompressionNone && info.Size() >= plainSize/2 {
+				t.Errorf("%v: %d bytes, uncompressed %d", c, info.Size(), plainSize)
+			}
+
+			got, err := readFile(t, path)
+			if err != nil {
+				t.Fatalf("%v/%d: %v", c, mode, err)
+			}
+			if !reflect.DeepEqual(got, readBack(items)) {
+				t.Fatalf("%v/%d: rows differ after a round trip", c, mode)
+			}
+
+			s, err := OpenSegment(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Header().Compression() != c {
+				t.Fatalf("header codec %v, want %v", s.Header().Compression(), c)
+			}
+			for pk := int64(-1); pk <= 5000; pk += 37 {
+				it, ok, err := s.Get(pk)
+				if err != nil || ok != (pk >= 0 && pk < 5000) || (ok && it.Row["n"] != pk) {
+					t.Fatalf("%v/%d: Get(%d) = %v, %v, %v", c, mode, pk, it, ok, err)
+				}
+			}
+			s.Close()
+		}
+	}
+}
+
+// readBack is items as a reader returns them: the tags array comes back from
+// its JSON encoding.
+func readBack(items []btree.Item) []btree.Item {
+	out := make([]btree.Item, len(items))
+	for i, it := range items {
+		row := make(btree.Row, len(it.Row))
+		for k, v := range it.Row {
+			row[k] = v
+		}
+		row["tags"] = []any{"alpha", "bravo"}
+		out[i] = btree.Item{PK: it.PK, Row: row}
+	}
+	return out
+}
+
+func TestCompressionDetectsDamage(t *testing.T) {
+	for c := CompressionSnappy; c <= maxCompression; c++ {
+		path := writeFile(t, WriterOptions{IndexBlockSize: 4096, Checksum: ChecksumBlock, Compression: c}, compressibleItems())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = bytes.Clone(b)
+		b[len(b)/2] ^= 0x10
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var ce *CorruptionError
+		if err := readErr(t, path); !errors.As(err, &ce) {
+			t.Errorf("%v: err %v, want *CorruptionError", c, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package btreeWriting
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// FormatVersion is the layout written by this build. Readers accept any
+	// version up to and including it.
+	//
+	//	0: no header, index or footer, only v1 records (see newLegacySegment)
+	//	1: fields are stored by name in every record
+	//	2: fields are stored by dictionary ID (header/footer carry the names)
+	//	3: primary keys are i64 (were u32)
+	//	4: tombstone records; the footer counts them
+	FormatVersion = 4
+
+	headerMagic = "SPDB"
+	headerSize  = 16 // fixed part; v2 appends the seed field dictionary
+
+	// knownFlags is every header flag bit this build understands. Files with
+	// other bits set were written by a newer build and are rejected.
+	knownFlags = FlagRecordChecksums | FlagBlockChecksums | FlagStringKeys
+
+	// The high byte of the flags holds the block Compression codec.
+	compressionShift = 8
+	featureFlagMask  = 0x00FF
+)
+
+// Header flags.
+const (
+	FlagRecordChecksums uint16 = 1 << iota
+	FlagBlockChecksums
+	FlagStringKeys // pks are strings ([u16 len][bytes]) instead of i64
+)
+
+var (
+	ErrNotSegment         = errors.New("not an .spdb file (bad magic)")
+	ErrUnsupportedVersion = errors.New("unsupported .spdb format version")
+)
+
+// Header is the block at the start of every .spdb file.
+type Header struct {
+	Version   uint16
+	Flags     uint16
+	CreatedAt time.Time
+
+	// Fields seeds the field dictionary (v2+): field i has ID i. Fields first
+	// seen after the header are defined inline and listed in the footer.
+	Fields []string
+}
+
+func (h Header) Compression() Compression {
+	return Compression(h.Flags >> compressionShift)
+}
+
+func (h Header) StringKeys() bool {
+	return h.Flags&FlagStringKeys != 0
+}
+
+func (h Header) Checksum() ChecksumMode {
+	switch {
+	case h.Flags&FlagRecordChecksums != 0:
+		return ChecksumRecord
+	case h.Flags&FlagBlockChecksums != 0:
+		return ChecksumBlock
+	default:
+		return ChecksumNone
+	}
+}
+
+func appendHeader(dst []byte, h Header) []byte {
+	dst = append(dst, headerMagic...)
+	dst = appendU16(dst, h.Version)
+	dst = appendU16(dst, h.Flags)
+	dst = appendI64(dst, h.CreatedAt.UnixNano())
+	if h.Version >= 2 {
+		dst = appendFieldNames(dst, h.Fields)
+	}
+	return dst
+}
+
+// appendFieldNames writes a dictionary as [u16 count] then [u8 len][name] per field.
+// Callers have already checked the count and name lengths.
+func appendFieldNames(dst []byte, names []string) []byte {
+	dst = appendU16(dst, uint16(len(names)))
+	for _, name := range names {
+		dst = append(dst, byte(len(name)))
+		dst = append(dst, name...)
+	}
+	return dst
+}
+
+func (d *decoder) fieldNames() []string {
+	n := d.u16()
+	names := make([]string, 0, n)
+	for i := 0; i < int(n) && d.err == nil; i++ {
+		l := d.u8()
+		names = append(names, string(d.bytes(int(l))))
+	}
+	return names
+}
+
+func decodeHeader(src []byte) (Header, error) {
+	if len(src) < headerSize || string(src[:4]) != headerMagic {
+		return Header{}, ErrNotSegment
+	}
+	h := Header{
+		Version:   binary.LittleEndian.Uint16(src[4:6]),
+		Flags:     binary.LittleEndian.Uint16(src[6:8]),
+		CreatedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(src[8:16]))),
+	}
+	if h.Version == 0 || h.Version > FormatVersion {
+		return Header{}, fmt.Errorf("%w %d (this build reads up to %d)", ErrUnsupportedVersion, h.Version, FormatVersion)
+	}
+	if unknown := h.Flags & featureFlagMask &^ knownFlags; unknown != 0 {
+		return Header{}, fmt.Errorf("unsupported header flags %#04x", unknown)
+	}
+	if c := h.Compression(); c > maxCompression {
+		return Header{}, fmt.Errorf("unsupported compression codec %d", uint8(c))
+	}
+	if h.Flags&FlagRecordChecksums != 0 && h.Flags&FlagBlockChecksums != 0 {
+		return Header{}, fmt.Errorf("header sets both record and block checksum flags")
+	}
+	return h, nil
+}
+
+// readHeader reads and validates the header, returning it and its size in bytes.
+func readHeader(r io.Reader) (Header, int, error) {
+	var b [headerSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return Header{}, 0, ErrNotSegment
+		}
+		return Header{}, 0, err
+	}
+	h, err := decodeHeader(b[:])
+	if err != nil {
+		return Header{}, 0, err
+	}
+	if h.Version < 2 {
+		return h, headerSize, nil
+	}
+
+	var countBuf [2]byte
+	if _, err := io.ReadFull(r, countBuf[:]); err != nil {
+		return Header{}, 0, fmt.Errorf("header field dictionary: %w", err)
+	}
+	size := headerSize + 2
+	h.Fields = make([]string, 0, binary.LittleEndian.Uint16(countBuf[:]))
+	for i := 0; i < cap(h.Fields); i++ {
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return Header{}, 0, fmt.Errorf("header field dictionary: %w", err)
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return Header{}, 0, fmt.Errorf("header field dictionary: %w", err)
+		}
+		h.Fields = append(h.Fields, string(name))
+		size += 1 + len(name)
+	}
+	return h, size, nil
+}
@@ -0,0 +1,92 @@
+package btreeWriting
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	created := time.Unix(1700000000, 123456789)
+	path := writeFile(t, WriterOptions{CreatedAt: created, Checksum: ChecksumBlock, Compression: CompressionZstd, Fields: []string{"a", "b"}}, nil)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := r.Header()
+	if h.Version != FormatVersion || !h.CreatedAt.Equal(created) {
+		t.Fatalf("header version %d created %v, want %d and %v", h.Version, h.CreatedAt, FormatVersion, created)
+	}
+	if h.Checksum() != ChecksumBlock || h.Compression() != CompressionZstd || h.StringKeys() {
+		t.Fatalf("header flags %#04x", h.Flags)
+	}
+	if len(h.Fields) != 2 || h.Fields[0] != "a" || h.Fields[1] != "b" {
+		t.Fatalf("header fields %q", h.Fields)
+	}
+}
+
+func TestHeaderRejects(t *testing.T) {
+	valid := appendHeader(nil, Header{Version: FormatVersion, CreatedAt: time.Unix(5, 0)})
+	with := func(off int, v uint16) []byte {
+		b := bytes.Clone(valid)
+		binary.LittleEndian.PutUint16(b[off:], v)
+		return b
+	}
+
+	tests := []struct {
+		name string
+		src  []byte
+		want error // nil: any error
+	}{
+		{"empty", nil, ErrNotSegment},
+		{"short", valid[:10], ErrNotSegment},
+		{"bad magic", append([]byte("SPDX"), valid[4:]...), ErrNotSegment},
+		{"version 0", with(4, 0), ErrUnsupportedVersion},
+		{"newer version", with(4, FormatVersion+1), ErrUnsupportedVersion},
+		{"unknown flag", with(6, 1<<7), nil},
+		{"unknown codec", with(6, uint16(maxCompression+1)<<compressionShift), nil},
+		{"both checksum modes", with(6, FlagRecordChecksums|FlagBlockChecksums), nil},
+		{"cut dictionary", valid[:headerSize+1], nil},
+	}
+	for _, tt := range tests {
+		_, _, err := readHeader(bytes.NewReader(tt.src))
+		if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	if _, _, err := readHeader(bytes.NewReader(valid)); err != nil {
+		t.Fatalf("valid header: %v", err)
+	}
+}
+
+func TestOpenSegmentRejectsBadHeader(t *testing.T) {
+	path := writeFile(t, WriterOptions{}, everyThird())
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[4] = FormatVersion + 1
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSegment(path); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("OpenSegment = %v, want ErrUnsupportedVersion", err)
+	}
+
+	if err := os.WriteFile(path, bytes.Repeat([]byte("garbage "), 20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSegment(path); !errors.Is(err, ErrNotSegment) {
+		t.Fatalf("OpenSegment = %v, want ErrNotSegment", err)
+	}
+}
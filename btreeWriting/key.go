@@ -0,0 +1,69 @@
+package btreeWriting
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Key is a primary key type the format can store. int64 keys are written as
+// [i64]; string keys as [u16 len][bytes], ordered bytewise, in files that set
+// FlagStringKeys.
+type Key interface {
+	int64 | string
+}
+
+// maxStringKeyLen is the longest string key a record can hold.
+const maxStringKeyLen = math.MaxUint16
+
+// ErrKeyType means a file's key type differs from the one it was opened with.
+var ErrKeyType = errors.New(".spdb key type mismatch")
+
+func isStringKey[K Key]() bool {
+	var k K
+	_, ok := any(k).(string)
+	return ok
+}
+
+// checkKeyType fails unless h's key type is K.
+func checkKeyType[K Key](h Header) error {
+	if h.StringKeys() == isStringKey[K]() {
+		return nil
+	}
+	if h.StringKeys() {
+		return fmt.Errorf("%w: file has string keys", ErrKeyType)
+	}
+	return fmt.Errorf("%w: file has int64 keys", ErrKeyType)
+}
+
+func appendKey[K Key](dst []byte, k K) ([]byte, error) {
+	switch k := any(k).(type) {
+	case int64:
+		return appendI64(dst, k), nil
+	case string:
+		if len(k) > maxStringKeyLen {
+			return dst, fmt.Errorf("key too long (%d bytes, max %d)", len(k), maxStringKeyLen)
+		}
+		dst = appendU16(dst, uint16(len(k)))
+		return append(dst, k...), nil
+	}
+	panic("unreachable")
+}
+
+// decodeKey reads a primary key: a string key, or an int64 stored as i64 from
+// v3 on and as u32 before that.
+func decodeKey[K Key](d *decoder, version uint16) K {
+	var k K
+	switch p := any(&k).(type) {
+	case *int64:
+		if version < 3 {
+			*p = int64(d.u32())
+		} else {
+			*p = int64(d.u64())
+		}
+	case *string:
+		n := d.u16()
+		*p = string(d.bytes(int(n)))
+	}
+	return k
+}
@@ -0,0 +1,385 @@
+package btreeWriting
+
+import (
+	"SpeedyDb/btree"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sort"
+)
+
+// FooterOf is the summary WriterOf.Close appends after the last record.
+type FooterOf[K Key] struct {
+	Index      []IndexEntryOf[K]
+	Records    uint64 // tombstones included
+	Tombstones uint64 // v4+
+	MinPK      K
+	MaxPK      K
+
+	// Fields is the complete field dictionary (v2+).
+	Fields []string
+}
+
+// SegmentOf is a read-only, seekable view of one .spdb file. It validates the
+// header, loads the footer once and uses the sparse index to jump to the block
+// that can hold a key.
+type SegmentOf[K Key] struct {
+	f         *os.File
+	header    Header
+	footer    FooterOf[K]
+	dataStart int64 // first byte after the header
+	dataEnd   int64 // first byte after the records and end marker
+}
+
+// OpenSegment opens path and reads its footer.
+func OpenSegment(path string) (*Segment, error) {
+	return OpenSegmentOf[int64](path)
+}
+
+// OpenSegmentOf is OpenSegment for any key type. It fails with ErrKeyType if
+// the file's keys are not K.
+func OpenSegmentOf[K Key](path string) (*SegmentOf[K], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSegment[K](f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func newSegment[K Key](f *os.File) (*SegmentOf[K], error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	var magic [len(headerMagic)]byte
+	if n, _ := f.ReadAt(magic[:], 0); n > 0 && string(magic[:n]) != headerMagic[:n] {
+		return newLegacySegment[K](f, size)
+	}
+	h, hdrSize, err := readHeader(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyType[K](h); err != nil {
+		return nil, err
+	}
+
+	// header + end marker + empty footer + trailer
+	if size < int64(hdrSize)+4+20+trailerSize {
+		return nil, fmt.Errorf("missing footer (file is %d bytes; incomplete write?)", size)
+	}
+	var trailer [trailerSize]byte
+	if _, err := f.ReadAt(trailer[:], size-trailerSize); err != nil {
+		return nil, fmt.Errorf("read trailer: %w", err)
+	}
+	if binary.LittleEndian.Uint32(trailer[12:16]) != footerMagic {
+		return nil, errors.New("missing footer (incomplete write?)")
+	}
+	if v := binary.LittleEndian.Uint32(trailer[8:12]); v != uint32(h.Version) {
+		return nil, fmt.Errorf("footer version %d does not match header version %d", v, h.Version)
+	}
+
+	footerOffset := int64(binary.LittleEndian.Uint64(trailer[0:8]))
+	if footerOffset < int64(hdrSize)+4 || footerOffset > size-trailerSize {
+		return nil, fmt.Errorf("footer offset %d out of range (file size %d)", footerOffset, size)
+	}
+	raw := make([]byte, size-trailerSize-footerOffset)
+	if _, err := f.ReadAt(raw, footerOffset); err != nil {
+		return nil, fmt.Errorf("read footer: %w", err)
+	}
+	footer, err := decodeFooter[K](raw, h)
+	if err != nil {
+		if errors.Is(err, errFooterChecksum) {
+			return nil, &CorruptionError{File: f.Name(), Offset: uint64(footerOffset), Reason: "footer checksum mismatch"}
+		}
+		return nil, fmt.Errorf("footer: %w", err)
+	}
+
+	return &SegmentOf[K]{f: f, header: h, footer: footer, dataStart: int64(hdrSize), dataEnd: footerOffset}, nil
+}
+
+// newLegacySegment opens a file written before .spdb files had a header
+// (version 0): v1 records, u32 pk and inline field names, from the first byte
+// to the last, with no end marker, index or footer. It reads every record once
+// to build the footer the file lacks; compacting such files rewrites them in
+// the current format.
+func newLegacySegment[K Key](f *os.File, size int64) (*SegmentOf[K], error) {
+	var h Header // version 0, int keys, no checksums
+	if err := checkKeyType[K](h); err != nil {
+		return nil, err
+	}
+	// the end marker is not in the file; records supplies it
+	s := &SegmentOf[K]{f: f, header: h, dataEnd: size + int64(len(endMarker))}
+
+	var zero K
+	r := s.ReaderFrom(zero, 1<<20)
+	var footer FooterOf[K]
+	var blockEnd uint64
+	for {
+		off := r.base + r.BytesRead
+		it, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if footer.Records == 0 {
+				// not even one record decodes: this is not a segment of any version
+				return nil, fmt.Errorf("%w (nor a headerless v0 file: %v)", ErrNotSegment, err)
+			}
+			return nil, err
+		}
+		if footer.Records > 0 && it.PK <= footer.MaxPK {
+			return nil, &CorruptionError{File: f.Name(), Offset: off, Reason: "records out of pk order"}
+		}
+		if footer.Records == 0 || off >= blockEnd {
+			footer.Index = append(footer.Index, IndexEntryOf[K]{FirstPK: it.PK, Offset: off})
+			blockEnd = off + DefaultIndexBlockSize
+		}
+		if footer.Records == 0 {
+			footer.MinPK = it.PK
+		}
+		footer.MaxPK = it.PK
+		footer.Records++
+	}
+	s.footer = footer
+	return s, nil
+}
+
+var errFooterChecksum = errors.New("footer checksum mismatch")
+
+func decodeFooter[K Key](src []byte, h Header) (FooterOf[K], error) {
+	if h.Checksum() != ChecksumNone {
+		if len(src) < 4 {
+			return FooterOf[K]{}, io.ErrUnexpectedEOF
+		}
+		body := src[:len(src)-4]
+		if binary.LittleEndian.Uint32(src[len(src)-4:]) != crc32.Checksum(body, crcTable) {
+			return FooterOf[K]{}, errFooterChecksum
+		}
+		src = body
+	}
+	d := decoder{src: src}
+
+	n := d.u32()
+	if d.err == nil && uint64(n)*10 > uint64(len(d.src)) { // entries are at least 10 bytes
+		return FooterOf[K]{}, fmt.Errorf("index count %d exceeds footer size", n)
+	}
+	index := make([]IndexEntryOf[K], 0, n)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		pk := decodeKey[K](&d, h.Version)
+		off := d.u64()
+		index = append(index, IndexEntryOf[K]{FirstPK: pk, Offset: off})
+	}
+	records := d.u64()
+	var tombstones uint64
+	if h.Version >= 4 {
+		tombstones = d.u64()
+	}
+	minPK := decodeKey[K](&d, h.Version)
+	maxPK := decodeKey[K](&d, h.Version)
+	var fields []string
+	if h.Version >= 2 {
+		fields = d.fieldNames()
+	}
+	if d.err != nil {
+		return FooterOf[K]{}, d.err
+	}
+	if len(d.src) != 0 {
+		return FooterOf[K]{}, fmt.Errorf("%d trailing bytes", len(d.src))
+	}
+	return FooterOf[K]{Index: index, Records: records, Tombstones: tombstones, MinPK: minPK, MaxPK: maxPK, Fields: fields}, nil
+}
+
+func (s *SegmentOf[K]) Header() Header {
+	return s.header
+}
+
+func (s *SegmentOf[K]) Footer() FooterOf[K] {
+	return s.footer
+}
+
+func (s *SegmentOf[K]) Close() error {
+	return s.f.Close()
+}
+
+// blockStart returns the offset of the block that would contain pk, or
+// ok=false if pk sorts before every key in the file.
+func (s *SegmentOf[K]) blockStart(pk K) (offset uint64, ok bool) {
+	i := s.blockIndex(pk)
+	if i < 0 {
+		return 0, false
+	}
+	return s.footer.Index[i].Offset, true
+}
+
+// blockIndex returns the index entry of the block that would contain pk, or -1
+// if pk sorts before every key in the file.
+func (s *SegmentOf[K]) blockIndex(pk K) int {
+	idx := s.footer.Index
+	return sort.Search(len(idx), func(i int) bool { return idx[i].FirstPK > pk }) - 1
+}
+
+// ReaderFrom returns a Reader positioned at the start of the block that can
+// hold pk, so the first record it yields may still be < pk; callers skip
+// forward. bufSize is the read buffer size (see NewReaderSize).
+func (s *SegmentOf[K]) ReaderFrom(pk K, bufSize int) *ReaderOf[K] {
+	off, ok := s.blockStart(pk)
+	if !ok {
+		// pk is below every key: start at the first record
+		off = uint64(s.dataStart)
+	}
+	r := newRecordReader[K](s.records(int64(off), s.dataEnd), bufSize)
+	r.header = s.header
+	r.dict = slices.Clip(s.footer.Fields)
+	r.base = off
+	r.end = uint64(s.dataEnd)
+	r.name = s.f.Name()
+	return r
+}
+
+// records returns the file's bytes [off, end). A v0 file has no end marker on
+// disk, so the one its dataEnd counts is supplied here.
+func (s *SegmentOf[K]) records(off, end int64) io.Reader {
+	if s.header.Version > 0 || end < s.dataEnd {
+		return io.NewSectionReader(s.f, off, end-off)
+	}
+	fileEnd := end - int64(len(endMarker))
+	return io.MultiReader(io.NewSectionReader(s.f, off, fileEnd-off), bytes.NewReader(endMarker[:]))
+}
+
+// ReverseFrom returns a ReverseReader positioned at the end of the block that
+// can hold pk, so the first records it yields may still be > pk; callers skip
+// them. bufSize is the read buffer size (see NewReaderSize).
+func (s *SegmentOf[K]) ReverseFrom(pk K, bufSize int) *ReverseReaderOf[K] {
+	return &ReverseReaderOf[K]{s: s, block: s.blockIndex(pk), bufSize: bufSize}
+}
+
+// ReverseReaderOf yields a segment's records in descending PK order. Records
+// can only be decoded front to back, so it reads one index block at a time,
+// last block first, and holds that block's rows in memory.
+type ReverseReaderOf[K Key] struct {
+	s       *SegmentOf[K]
+	block   int               // next index block to load; -1 when none are left
+	items   []btree.ItemOf[K] // current block, ascending; yielded from the end
+	bufSize int
+}
+
+// ReverseReader is the int64-keyed form.
+type ReverseReader = ReverseReaderOf[int64]
+
+// Next returns the previous record, or io.EOF once the first record is passed.
+func (r *ReverseReaderOf[K]) Next() (btree.ItemOf[K], error) {
+	for len(r.items) == 0 {
+		if r.block < 0 {
+			return btree.ItemOf[K]{}, io.EOF
+		}
+		if err := r.loadBlock(); err != nil {
+			return btree.ItemOf[K]{}, err
+		}
+	}
+	it := r.items[len(r.items)-1]
+	r.items[len(r.items)-1] = btree.ItemOf[K]{}
+	r.items = r.items[:len(r.items)-1]
+	return it, nil
+}
+
+// endMarker is appended after a single block so a Reader stops cleanly at
+// the block boundary instead of reporting a missing end-of-records marker.
+var endMarker [4]byte
+
+// loadBlock reads index block r.block in full (verifying its checksum) and
+// steps r.block back by one.
+func (r *ReverseReaderOf[K]) loadBlock() error {
+	s := r.s
+	start := int64(s.footer.Index[r.block].Offset)
+	end := s.dataEnd - int64(len(endMarker)) // the file's own end marker
+	if r.block+1 < len(s.footer.Index) {
+		end = int64(s.footer.Index[r.block+1].Offset)
+	}
+	r.block--
+
+	src := io.MultiReader(io.NewSectionReader(s.f, start, end-start), bytes.NewReader(endMarker[:]))
+	rd := newRecordReader[K](src, r.bufSize)
+	rd.header = s.header
+	rd.dict = slices.Clip(s.footer.Fields)
+	rd.base = uint64(start)
+	rd.end = uint64(end) + uint64(len(endMarker))
+	rd.name = s.f.Name()
+	for {
+		it, err := rd.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			r.items = r.items[:0]
+			return err
+		}
+		r.items = append(r.items, it)
+	}
+}
+
+// LoadTree reads every record, tombstones included, into a new B-tree of
+// minimum degree t, bulk-loading it since the file is already sorted.
+func (s *SegmentOf[K]) LoadTree(t int) (*btree.BTreeOf[K], error) {
+	r := s.ReaderFrom(s.footer.MinPK, 1<<20) // reads the whole file, so buffer generously
+	var readErr error
+	tr, err := btree.BulkLoadOf(t, func() (btree.ItemOf[K], bool) {
+		it, err := r.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				readErr = err
+			}
+			return btree.ItemOf[K]{}, false
+		}
+		return it, true
+	})
+	if readErr != nil {
+		return nil, readErr
+	}
+	return tr, err
+}
+
+// Get returns the record for pk, reading at most one index block. A tombstone
+// is returned as found with Deleted set, so callers stop looking in older files.
+func (s *SegmentOf[K]) Get(pk K) (btree.ItemOf[K], bool, error) {
+	if s.footer.Records == 0 || pk < s.footer.MinPK || pk > s.footer.MaxPK {
+		return btree.ItemOf[K]{}, false, nil
+	}
+	if _, ok := s.blockStart(pk); !ok {
+		return btree.ItemOf[K]{}, false, nil
+	}
+
+	// a block is ~IndexBlockSize bytes, so a small buffer avoids over-reading
+	r := s.ReaderFrom(pk, 32<<10)
+	for {
+		it, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return btree.ItemOf[K]{}, false, nil
+		}
+		if err != nil {
+			return btree.ItemOf[K]{}, false, err
+		}
+		// records are in ascending PK order
+		if it.PK >= pk {
+			// with block checksums, only trust the row once its whole block checks out
+			if err := r.FinishBlock(); err != nil {
+				return btree.ItemOf[K]{}, false, err
+			}
+			if it.PK == pk {
+				return it, true, nil
+			}
+			return btree.ItemOf[K]{}, false, nil
+		}
+	}
+}
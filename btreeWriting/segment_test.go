@@ -0,0 +1,385 @@
+package btreeWriting
+
+import (
+	"SpeedyDb/btree"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// everyThird returns items for 10, 13, ... below 5000.
+func everyThird() []btree.Item {
+	var items []btree.Item
+	for pk := int64(10); pk < 5000; pk += 3 {
+		items = append(items, btree.Item{PK: pk, Row: btree.Row{"v": pk, "s": "hello"}})
+	}
+	return items
+}
+
+func TestSegmentIndexAndFooter(t *testing.T) {
+	items := everyThird()
+	s, err := OpenSegment(writeFile(t, WriterOptions{IndexBlockSize: 200}, items))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ft := s.Footer()
+	if ft.Records != uint64(len(items)) || ft.MinPK != 10 || ft.MaxPK != items[len(items)-1].PK {
+		t.Fatalf("footer: %d records, pk %d..%d", ft.Records, ft.MinPK, ft.MaxPK)
+	}
+	if len(ft.Index) < 10 {
+		t.Fatalf("%d index entries for %d records in 200-byte blocks", len(ft.Index), len(items))
+	}
+	if ft.Index[0].FirstPK != 10 {
+		t.Fatalf("first block starts at pk %d", ft.Index[0].FirstPK)
+	}
+	for i := 1; i < len(ft.Index); i++ {
+		if ft.Index[i].FirstPK <= ft.Index[i-1].FirstPK || ft.Index[i].Offset <= ft.Index[i-1].Offset {
+			t.Fatalf("index entries %d and %d out of order: %+v %+v", i-1, i, ft.Index[i-1], ft.Index[i])
+		}
+	}
+
+	for pk := int64(0); pk < 5100; pk++ {
+		it, ok, err := s.Get(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := pk >= 10 && pk < 5000 && (pk-10)%3 == 0
+		if ok != want || (ok && it.Row["v"] != pk) {
+			t.Fatalf("Get(%d) = %v, %v, want found=%v", pk, it, ok, want)
+		}
+	}
+}
+
+func TestSegmentReaderFrom(t *testing.T) {
+	items := everyThird()
+	s, err := OpenSegment(writeFile(t, WriterOptions{IndexBlockSize: 200}, items))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, from := range []int64{0, 10, 11, 2000, 4999, 6000} {
+		r := s.ReaderFrom(from, 4096)
+		first, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			t.Fatalf("ReaderFrom(%d) is empty", from)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the reader starts at the block holding from, so at most one block early
+		if first.PK > max(from, 10) {
+			t.Fatalf("ReaderFrom(%d) starts past it, at %d", from, first.PK)
+		}
+		if min(from, items[len(items)-1].PK)-first.PK > 200 {
+			t.Fatalf("ReaderFrom(%d) starts far before it, at %d", from, first.PK)
+		}
+		n := 1
+		for prev := first.PK; ; n++ {
+			it, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if it.PK != prev+3 {
+				t.Fatalf("ReaderFrom(%d): %d follows %d", from, it.PK, prev)
+			}
+			prev = it.PK
+		}
+		if want := int(items[len(items)-1].PK-first.PK)/3 + 1; n != want {
+			t.Fatalf("ReaderFrom(%d) read %d records, want %d", from, n, want)
+		}
+	}
+}
+
+func TestWriterRejectsUnsorted(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "unsorted.spdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f)
+	defer w.Close()
+	if err := w.WriteItem(btree.Item{PK: 5}); err != nil {
+		t.Fatal(err)
+	}
+	for _, pk := range []int64{5, 4} {
+		if err := w.WriteItem(btree.Item{PK: pk}); err == nil {
+			t.Errorf("WriteItem(%d) after 5 succeeded", pk)
+		}
+	}
+}
+
+func TestSegmentMissingFooter(t *testing.T) {
+	path := writeFile(t, WriterOptions{}, everyThird())
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{len(b) - 1, len(b) / 2, 30} {
+		if err := os.WriteFile(path, b[:size], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if s, err := OpenSegment(path); err == nil {
+			s.Close()
+			t.Errorf("opened a segment cut to %d of %d bytes", size, len(b))
+		}
+	}
+}
+
+func TestSegmentInt64Keys(t *testing.T) {
+	pks := []int64{math.MinInt64, -1 << 40, -3, 0, 1 << 32, 1<<33 + 1, math.MaxInt64}
+	var items []btree.Item
+	for _, pk := range pks {
+		items = append(items, btree.Item{PK: pk, Row: btree.Row{"v": pk}})
+	}
+	path := writeFile(t, WriterOptions{IndexBlockSize: 32}, items)
+
+	got, err := readFile(t, path)
+	if err != nil || len(got) != len(pks) {
+		t.Fatalf("read %d records, %v", len(got), err)
+	}
+	for i, it := range got {
+		if it.PK != pks[i] || it.Row["v"] != pks[i] {
+			t.Fatalf("record %d = %v, want pk %d", i, it, pks[i])
+		}
+	}
+
+	s, err := OpenSegment(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if ft := s.Footer(); ft.MinPK != math.MinInt64 || ft.MaxPK != math.MaxInt64 {
+		t.Fatalf("footer range %d..%d", ft.MinPK, ft.MaxPK)
+	}
+	for _, pk := range pks {
+		if it, ok, err := s.Get(pk); err != nil || !ok || it.PK != pk {
+			t.Fatalf("Get(%d) = %v, %v, %v", pk, it, ok, err)
+		}
+	}
+	// keys that only differ from stored ones above bit 31
+	for _, pk := range []int64{1 << 31, 1<<33 + 1 - 1<<32, math.MinInt64 + 1, math.MaxInt64 - 1} {
+		if _, ok, err := s.Get(pk); err != nil || ok {
+			t.Fatalf("Get(%d) = %v, %v, want not found", pk, ok, err)
+		}
+	}
+}
+
+func TestSegmentTombstones(t *testing.T) {
+	var items []btree.Item
+	for pk := int64(0); pk < 300; pk++ {
+		if pk%7 == 0 {
+			items = append(items, btree.Item{PK: pk, Deleted: true})
+		} else {
+			items = append(items, btree.Item{PK: pk, Row: btree.Row{"v": pk}})
+		}
+	}
+	for _, c := range []Compression{CompressionNone, CompressionLZ4} {
+		path := writeFile(t, WriterOptions{IndexBlockSize: 128, Checksum: ChecksumBlock, Compression: c}, items)
+		got, err := readFile(t, path)
+		if err != nil || len(got) != len(items) {
+			t.Fatalf("%v: read %d records, %v", c, len(got), err)
+		}
+		for i, it := range got {
+			if it.PK != items[i].PK || it.Deleted != items[i].Deleted || (it.Deleted && it.Row != nil) {
+				t.Fatalf("%v: record %d = %+v, want %+v", c, i, it, items[i])
+			}
+		}
+
+		s, err := OpenSegment(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ft := s.Footer(); ft.Records != 300 || ft.Tombstones != 43 {
+			t.Fatalf("%v: footer counts %d records, %d tombstones", c, ft.Records, ft.Tombstones)
+		}
+		// a tombstone is found, so callers stop looking in older files
+		if it, ok, err := s.Get(14); err != nil || !ok || !it.Deleted {
+			t.Fatalf("%v: Get(14) = %+v, %v, %v, want a tombstone", c, it, ok, err)
+		}
+		s.Close()
+	}
+}
+
+func TestSegmentStringKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "strings.spdb")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriterOf[string](f, WriterOptions{IndexBlockSize: 64, Checksum: ChecksumBlock})
+	keys := []string{"", "a", "a\x00", "ab", "b", strings.Repeat("k", maxStringKeyLen), "\xff"}
+	for _, k := range keys {
+		if err := w.WriteItem(btree.ItemOf[string]{PK: k, Row: btree.Row{"len": int64(len(k))}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteItem(btree.ItemOf[string]{PK: "\xff" + strings.Repeat("z", maxStringKeyLen)}); err == nil {
+		t.Fatal("WriteItem took a key longer than the format allows")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenSegmentOf[string](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.Header().StringKeys() || s.Footer().MinPK != "" || s.Footer().MaxPK != keys[len(keys)-1] {
+		t.Fatalf("header flags %#04x, footer range %q..%.10q", s.Header().Flags, s.Footer().MinPK, s.Footer().MaxPK)
+	}
+	for _, k := range keys {
+		if it, ok, err := s.Get(k); err != nil || !ok || it.Row["len"] != int64(len(k)) {
+			t.Fatalf("Get(%.10q) = %v, %v, %v", k, it, ok, err)
+		}
+	}
+	for _, k := range []string{"a\x01", "aa", "c"} {
+		if _, ok, err := s.Get(k); err != nil || ok {
+			t.Fatalf("Get(%q) = %v, %v, want not found", k, ok, err)
+		}
+	}
+
+	if _, err := OpenSegment(path); !errors.Is(err, ErrKeyType) {
+		t.Fatalf("OpenSegment of a string-keyed file = %v, want ErrKeyType", err)
+	}
+	if _, err := OpenSegmentOf[string](writeFile(t, WriterOptions{}, everyThird())); !errors.Is(err, ErrKeyType) {
+		t.Fatalf("OpenSegmentOf[string] of an int64-keyed file = %v, want ErrKeyType", err)
+	}
+}
+
+func TestSegmentReverseFrom(t *testing.T) {
+	var items []btree.Item
+	for pk := int64(10); pk < 3000; pk += 3 {
+		if pk%7 == 0 {
+			items = append(items, btree.Item{PK: pk, Deleted: true})
+		} else {
+			items = append(items, btree.Item{PK: pk, Row: btree.Row{"v": pk}})
+		}
+	}
+	for _, mode := range []ChecksumMode{ChecksumNone, ChecksumRecord, ChecksumBlock} {
+		for _, c := range []Compression{CompressionNone, CompressionZstd} {
+			s, err := OpenSegment(writeFile(t, WriterOptions{IndexBlockSize: 200, Checksum: mode, Compression: c}, items))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, from := range []int64{5000, 2998, 1500, 10, 9} {
+				r := s.ReverseFrom(from, 4096)
+				want := int64(2998)
+				for want > from {
+					want -= 3
+				}
+				for {
+					it, err := r.Next()
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					// the first block may hold keys past from
+					if it.PK > from {
+						continue
+					}
+					if it.PK != want || it.Deleted != (want%7 == 0) {
+						t.Fatalf("%d/%v: ReverseFrom(%d) gave %+v, want pk %d", mode, c, from, it, want)
+					}
+					want -= 3
+				}
+				if want != 7 {
+					t.Fatalf("%d/%v: ReverseFrom(%d) stopped before %d", mode, c, from, want)
+				}
+			}
+			s.Close()
+		}
+	}
+}
+
+// v0File writes items the way builds before the file header did: bare
+// [u32 len][u32 pk][u16 n] records with inline names, and nothing else.
+func v0File(t *testing.T, items []btree.Item) string {
+	t.Helper()
+	var b []byte
+	for _, it := range items {
+		rec := appendU32(nil, uint32(it.PK))
+		rec = appendU16(rec, 2)
+		rec = append(rec, 1, 'v', tagInt64)
+		rec = appendI64(rec, it.Row["v"].(int64))
+		rec = append(rec, 1, 's', tagString)
+		rec = appendU32(rec, uint32(len(it.Row["s"].(string))))
+		rec = append(rec, it.Row["s"].(string)...)
+		b = append(appendU32(b, uint32(len(rec))), rec...)
+	}
+	path := filepath.Join(t.TempDir(), "10_4999.spdb")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSegmentHeaderless(t *testing.T) {
+	var items []btree.Item
+	for pk := int64(10); pk < 20000; pk += 3 {
+		items = append(items, btree.Item{PK: pk, Row: btree.Row{"v": pk, "s": "hello"}})
+	}
+	path := v0File(t, items)
+	s, err := OpenSegment(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ft := s.Footer()
+	if s.Header().Version != 0 || ft.Records != uint64(len(items)) || ft.MinPK != 10 || ft.MaxPK != items[len(items)-1].PK {
+		t.Fatalf("v%d, %d records, pk %d..%d", s.Header().Version, ft.Records, ft.MinPK, ft.MaxPK)
+	}
+	if len(ft.Index) < 2 {
+		t.Fatalf("%d index entries for a %d-record file", len(ft.Index), len(items))
+	}
+	for _, pk := range []int64{10, 13, 9001, items[len(items)-1].PK} {
+		it, ok, err := s.Get(pk)
+		if err != nil || !ok || it.Row["v"] != pk || it.Row["s"] != "hello" {
+			t.Fatalf("Get(%d) = %v, %v, %v", pk, it, ok, err)
+		}
+	}
+	if _, ok, err := s.Get(11); ok || err != nil {
+		t.Fatalf("Get(11) = %v, %v", ok, err)
+	}
+	tr, err := s.LoadTree(32)
+	if err != nil || tr.Len() != len(items) {
+		t.Fatalf("LoadTree read %v, %v", tr, err)
+	}
+	r := s.ReverseFrom(math.MaxInt64, 4096)
+	for i := len(items) - 1; i >= 0; i-- {
+		if it, err := r.Next(); err != nil || it.PK != items[i].PK {
+			t.Fatalf("ReverseFrom gave %v, %v, want pk %d", it, err, items[i].PK)
+		}
+	}
+	if _, err := r.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("ReverseFrom past the first record = %v", err)
+	}
+
+	if _, err := OpenSegmentOf[string](path); !errors.Is(err, ErrKeyType) {
+		t.Fatalf("OpenSegmentOf[string] = %v, want ErrKeyType", err)
+	}
+	// v0 files have no footer to vouch for their length, so a cut record is damage
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b[:len(b)-3], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := OpenSegment(path); err == nil {
+		s.Close()
+		t.Fatal("opened a v0 file with a cut record")
+	}
+}
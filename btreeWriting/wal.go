@@ -0,0 +1,410 @@
+package btreeWriting
+
+import (
+	"SpeedyDb/btree"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A WAL (write-ahead log) records every write to an in-memory tree so the tree
+// can be rebuilt after a crash. It reuses the segment format:
+//
+//	header:  as in an .spdb file, with FlagRecordChecksums set
+//	record*: [u32 len][record body][u32 crc32c], as in a ChecksumRecord segment
+//
+// but records are in the order they were written, not pk order, and there is no
+// end marker, index or footer: the log ends after its last whole record. Field
+// names are defined inline on first use, as in a segment.
+//
+// A crash can leave a torn record at the end: a frame that runs past the end
+// of the file, or zeros where a file system grew the file but lost the data
+// (no frame has a zero length). Opening the log cuts it off, so appends
+// continue from a clean end. A record that is all there but fails its checksum or does not decode is
+// damage, not a torn write, and is reported as a *CorruptionError with the
+// file left as it is.
+
+// SyncPolicy says when a WAL fsyncs. Append always hands its record to the
+// OS before it returns, so a crash of the process loses nothing; the policy
+// decides how much a crash of the machine can lose.
+type SyncPolicy uint8
+
+const (
+	// SyncAlways fsyncs every Append before it returns. Nothing acknowledged
+	// is lost, but every write waits for the disk.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background every WALOptions.SyncEvery while
+	// there are unsynced records, whether or not more appends come. A machine
+	// crash loses at most that much.
+	SyncInterval
+	// SyncNone leaves syncing to the OS.
+	SyncNone
+)
+
+// DefaultSyncEvery is the SyncInterval period when WALOptions.SyncEvery is 0.
+const DefaultSyncEvery = time.Second
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNone:
+		return "none"
+	default:
+		return fmt.Sprintf("SyncPolicy(%d)", uint8(p))
+	}
+}
+
+// ParseSyncPolicy maps a policy name (as printed by String) to a SyncPolicy.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncInterval, SyncNone} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q (want always, interval or none)", s)
+}
+
+type WALOptions struct {
+	Sync SyncPolicy
+
+	// SyncEvery is the SyncInterval period. 0 means DefaultSyncEvery.
+	SyncEvery time.Duration
+
+	// Fields seeds the field dictionary of a new log, as WriterOptions.Fields.
+	Fields []string
+}
+
+// WALOf is an open write-ahead log for a tree keyed by K. Its methods are
+// for one goroutine; with SyncInterval a second one of its own does the
+// syncing.
+type WALOf[K Key] struct {
+	f     *os.File
+	sync  SyncPolicy
+	every time.Duration
+	buf   []byte
+
+	mu      sync.Mutex // orders writes and syncs with the interval syncer
+	dirty   bool       // records written since the last fsync
+	syncErr error      // a failed background fsync, returned by the next call
+	stop    chan struct{}
+	stopped chan struct{}
+
+	itemEncoder[K]
+
+	Records uint64 // in the file, replayed ones included
+}
+
+// WAL is the int64-keyed form.
+type WAL = WALOf[int64]
+
+// CreateWALOf starts an empty log at path, replacing any file there.
+func CreateWALOf[K Key](path string, opts WALOptions) (*WALOf[K], error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := newWAL[K](f, opts)
+	w.seedFields(opts.Fields)
+
+	flags := FlagRecordChecksums
+	if isStringKey[K]() {
+		flags |= FlagStringKeys
+	}
+	hdr := appendHeader(nil, Header{Version: FormatVersion, Flags: flags, CreatedAt: time.Now(), Fields: w.fieldNames})
+	if _, err := f.Write(hdr); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	// the log must not vanish with the directory entry a crash may lose
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	w.startSyncer()
+	return w, nil
+}
+
+// syncDir fsyncs a directory, making the files created in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// OpenWALOf opens the log at path for appending, first calling replay with
+// each record in it, in the order they were written. A missing file is created
+// empty. A torn record at the end is cut off; a damaged one is returned as a
+// *CorruptionError and the file is not touched. If replay returns an error,
+// OpenWALOf stops and returns it.
+func OpenWALOf[K Key](path string, opts WALOptions, replay func(btree.ItemOf[K]) error) (*WALOf[K], error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return CreateWALOf[K](path, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w := newWAL[K](f, opts)
+	end, err := w.replay(replay)
+	if err == nil {
+		err = w.truncate(end)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	w.startSyncer()
+	return w, nil
+}
+
+// ReplayWALOf calls fn with each record of the log at path without opening it
+// for writing, e.g. for a log that has been rotated out. A missing file has no
+// records. A torn record at the end is skipped and a damaged one is returned
+// as a *CorruptionError, as in OpenWALOf.
+func ReplayWALOf[K Key](path string, fn func(btree.ItemOf[K]) error) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = newWAL[K](f, WALOptions{}).replay(fn)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func newWAL[K Key](f *os.File, opts WALOptions) *WALOf[K] {
+	if opts.SyncEvery <= 0 {
+		opts.SyncEvery = DefaultSyncEvery
+	}
+	return &WALOf[K]{f: f, sync: opts.Sync, every: opts.SyncEvery}
+}
+
+// startSyncer starts the goroutine that syncs a SyncInterval log.
+func (w *WALOf[K]) startSyncer() {
+	if w.sync != SyncInterval {
+		return
+	}
+	w.stop = make(chan struct{})
+	w.stopped = make(chan struct{})
+	go func() {
+		defer close(w.stopped)
+		tick := time.NewTicker(w.every)
+		defer tick.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-tick.C:
+			}
+			w.mu.Lock()
+			if w.dirty && w.syncErr == nil {
+				w.syncErr = w.syncLocked()
+			}
+			w.mu.Unlock()
+		}
+	}()
+}
+
+// replay reads w's file from the start, calling fn for each whole record, and
+// seeds the encoder with every field name the log defines. It returns the
+// offset just past the last good record, which is the end of the file unless
+// a torn record follows.
+func (w *WALOf[K]) replay(fn func(btree.ItemOf[K]) error) (int64, error) {
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	info, err := w.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r, err := NewReaderOf[K](w.f, 1<<20)
+	if err != nil {
+		return 0, err
+	}
+	if r.header.Checksum() != ChecksumRecord || r.header.Compression() != CompressionNone {
+		return 0, fmt.Errorf("not a write-ahead log (header flags %#04x)", r.header.Flags)
+	}
+
+	end, fields := int64(r.base), len(r.dict)
+	for end < info.Size() {
+		it, err := r.Next()
+		if err != nil {
+			torn, tornErr := w.tornAt(end, info.Size())
+			if tornErr != nil {
+				return 0, tornErr
+			}
+			if torn {
+				break
+			}
+			var ce *CorruptionError
+			if !errors.As(err, &ce) {
+				err = &CorruptionError{File: w.f.Name(), Offset: uint64(end), Reason: err.Error()}
+			}
+			return 0, err
+		}
+		if err := fn(it); err != nil {
+			return 0, err
+		}
+		end, fields = int64(r.base+r.BytesRead), len(r.dict)
+		w.Records++
+	}
+	// names defined by a record that is about to be cut off are not taken
+	w.seedFields(r.dict[:fields])
+	return end, nil
+}
+
+// tornAt reports whether the frame at off is a torn tail: one that runs past
+// size, the end of the file, as a crash in the middle of an append leaves
+// behind, or zeros from off to the end. A zero length with anything else after
+// it is damage and returned as a *CorruptionError.
+func (w *WALOf[K]) tornAt(off, size int64) (bool, error) {
+	var prefix [4]byte
+	if size-off < int64(len(prefix)) {
+		return true, nil
+	}
+	if _, err := w.f.ReadAt(prefix[:], off); err != nil {
+		return false, err
+	}
+	recLen := binary.LittleEndian.Uint32(prefix[:])
+	if recLen == 0 {
+		zeros, err := w.zerosFrom(off+int64(len(prefix)), size)
+		if err != nil || zeros {
+			return zeros, err
+		}
+		return false, &CorruptionError{File: w.f.Name(), Offset: uint64(off), Reason: "zero record length followed by data"}
+	}
+	// prefix, body and crc
+	frameLen := 4 + int64(recLen) + 4
+	return off+frameLen > size, nil
+}
+
+// zerosFrom reports whether every byte of the file from off to size is zero.
+func (w *WALOf[K]) zerosFrom(off, size int64) (bool, error) {
+	buf := make([]byte, 32<<10)
+	for off < size {
+		n, err := w.f.ReadAt(buf[:min(int64(len(buf)), size-off)], off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, err
+		}
+		if n == 0 {
+			return false, io.ErrUnexpectedEOF
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		off += int64(n)
+	}
+	return true, nil
+}
+
+// truncate cuts the file to size, syncs it and moves to its end for appends.
+func (w *WALOf[K]) truncate(size int64) error {
+	if err := w.f.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// Append logs one write: an upsert, or a tombstone for a delete. The record
+// is written to the file in one piece before Append returns, and is as
+// durable as the sync policy makes it.
+func (w *WALOf[K]) Append(it btree.ItemOf[K]) error {
+	w.pendingFields = w.pendingFields[:0]
+	var prefix [4]byte
+	frame, err := w.encodeItemInto(append(w.buf[:0], prefix[:]...), it)
+	w.buf = frame
+	if err != nil {
+		return err
+	}
+	body := frame[len(prefix):]
+	if len(body) >= blockChecksumMarker {
+		return fmt.Errorf("record for pk %v too large (%d bytes)", it.PK, len(body))
+	}
+	binary.LittleEndian.PutUint32(frame, uint32(len(body)))
+	frame = binary.LittleEndian.AppendUint32(frame, crc32.Checksum(frame, crcTable))
+	w.buf = frame
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+	if _, err := w.f.Write(frame); err != nil {
+		return err
+	}
+	w.dirty = true
+	w.commitFields()
+	w.Records++
+	if w.sync == SyncAlways {
+		return w.syncLocked()
+	}
+	return nil
+}
+
+// Sync fsyncs the file.
+func (w *WALOf[K]) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+	return w.syncLocked()
+}
+
+func (w *WALOf[K]) syncLocked() error {
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// Close stops the interval syncer, syncs and closes the log.
+func (w *WALOf[K]) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.stopped
+		w.stop = nil
+	}
+	if err := w.Sync(); err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// Name returns the log's file name.
+func (w *WALOf[K]) Name() string {
+	return w.f.Name()
+}
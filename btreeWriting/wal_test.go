@@ -0,0 +1,296 @@
+package btreeWriting
+
+import (
+	"SpeedyDb/btree"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replayAll replays the log at path and returns its records.
+func replayAll(t *testing.T, path string) ([]btree.Item, error) {
+	t.Helper()
+	var items []btree.Item
+	err := ReplayWALOf(path, func(it btree.Item) error {
+		items = append(items, it)
+		return nil
+	})
+	return items, err
+}
+
+// openAll opens the log at path and returns it with the records it replayed.
+func openAll(t *testing.T, path string, opts WALOptions) (*WAL, []btree.Item) {
+	t.Helper()
+	var items []btree.Item
+	w, err := OpenWALOf(path, opts, func(it btree.Item) error {
+		items = append(items, it)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, items
+}
+
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, got := openAll(t, path, WALOptions{Sync: SyncAlways, Fields: []string{"a"}})
+	if len(got) != 0 {
+		t.Fatalf("a new log replayed %d records", len(got))
+	}
+	schema := btree.NewSchema([]string{"a", "b"})
+	packed, err := btree.PackRow(schema, []string{"b"}, []any{"pb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, it := range []btree.Item{
+		{PK: 5, Row: btree.Row{"a": int64(1), "c": "x"}},
+		{PK: 1, Packed: packed},
+		{PK: 5, Deleted: true},
+	} {
+		if err := w.Append(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// records come back in the order they were written, not pk order
+	w, got = openAll(t, path, WALOptions{Sync: SyncNone})
+	want := []btree.Item{
+		{PK: 5, Row: btree.Row{"a": int64(1), "c": "x"}},
+		{PK: 1, Row: btree.Row{"b": "pb"}},
+		{PK: 5, Deleted: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+	// appends after a reopen reuse the names the log already defines
+	if err := w.Append(btree.Item{PK: 7, Row: btree.Row{"d": true, "c": "y"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := replayAll(t, path); err != nil || len(got) != 4 || !reflect.DeepEqual(got[3].Row, btree.Row{"d": true, "c": "y"}) {
+		t.Fatalf("replayed %v, %v", got, err)
+	}
+
+	if _, err := OpenWALOf(path, WALOptions{}, func(btree.ItemOf[string]) error { return nil }); !errors.Is(err, ErrKeyType) {
+		t.Fatalf("OpenWALOf[string] of an int64 log = %v, want ErrKeyType", err)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, _ := openAll(t, path, WALOptions{Sync: SyncNone})
+	for pk := int64(0); pk < 3; pk++ {
+		if err := w.Append(btree.Item{PK: pk, Row: btree.Row{"v": pk}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := info.Size()
+	if err := w.Append(btree.Item{PK: 3, Row: btree.Row{"new": 1.5}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cut the last record in its length prefix, body and crc
+	for _, size := range []int64{good + 2, good + 6, int64(len(b)) - 1} {
+		if err := os.WriteFile(path, b[:size], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := replayAll(t, path); err != nil || len(got) != 3 {
+			t.Fatalf("cut to %d: ReplayWALOf read %d records, %v", size, len(got), err)
+		}
+
+		w, got := openAll(t, path, WALOptions{Sync: SyncNone})
+		if len(got) != 3 {
+			t.Fatalf("cut to %d: replayed %d records, want 3", size, len(got))
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() != good {
+			t.Fatalf("cut to %d: torn record left in place", size)
+		}
+		// "new" was defined by the torn record, so it has to be defined again
+		if err := w.Append(btree.Item{PK: 3, Row: btree.Row{"new": 2.5}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := replayAll(t, path); err != nil || len(got) != 4 || got[3].Row["new"] != 2.5 {
+			t.Fatalf("cut to %d: after appending, replayed %v, %v", size, got, err)
+		}
+	}
+}
+
+func TestWALZeroTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, _ := openAll(t, path, WALOptions{Sync: SyncNone})
+	for pk := int64(0); pk < 3; pk++ {
+		if err := w.Append(btree.Item{PK: pk, Row: btree.Row{"v": pk}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file grew but the data never landed
+	for _, n := range []int{1, 4, 8, 4096} {
+		if err := os.WriteFile(path, append(slices.Clone(b), make([]byte, n)...), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := replayAll(t, path); err != nil || len(got) != 3 {
+			t.Fatalf("%d zeros: ReplayWALOf read %d records, %v", n, len(got), err)
+		}
+		w, got := openAll(t, path, WALOptions{Sync: SyncNone})
+		if len(got) != 3 {
+			t.Fatalf("%d zeros: replayed %d records, want 3", n, len(got))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() != int64(len(b)) {
+			t.Fatalf("%d zeros: the zeros were left in place", n)
+		}
+	}
+
+	// a zero length with a record after it is not a torn tail
+	damaged := append(append(slices.Clone(b), make([]byte, 8)...), 1)
+	if err := os.WriteFile(path, damaged, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var ce *CorruptionError
+	if _, err := OpenWALOf(path, WALOptions{}, func(btree.Item) error { return nil }); !errors.As(err, &ce) || !strings.Contains(ce.Reason, "zero record length") {
+		t.Fatalf("OpenWALOf = %v, want a zero record length *CorruptionError", err)
+	}
+	if after, err := os.ReadFile(path); err != nil || !bytes.Equal(after, damaged) {
+		t.Fatal("the damaged log was changed")
+	}
+}
+
+func TestWALCorruptionKeepsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, _ := openAll(t, path, WALOptions{Sync: SyncNone})
+	for pk := int64(0); pk < 50; pk++ {
+		if err := w.Append(btree.Item{PK: pk, Row: btree.Row{"v": pk, "s": "hello world"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// damage a record in the middle, with whole records after it
+	b[len(b)/2] ^= 0x40
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var ce *CorruptionError
+	if _, err := replayAll(t, path); !errors.As(err, &ce) {
+		t.Fatalf("ReplayWALOf = %v, want *CorruptionError", err)
+	}
+	if _, err := OpenWALOf(path, WALOptions{}, func(btree.Item) error { return nil }); !errors.As(err, &ce) {
+		t.Fatalf("OpenWALOf = %v, want *CorruptionError", err)
+	} else if ce.Offset > uint64(len(b)/2) {
+		t.Fatalf("damage at byte %d reported at %d", len(b)/2, ce.Offset)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, b) {
+		t.Fatalf("the damaged log was changed: %d bytes, was %d", len(after), len(b))
+	}
+}
+
+func TestWALAppendReachesFile(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNone} {
+		path := filepath.Join(t.TempDir(), "test.wal")
+		w, _ := openAll(t, path, WALOptions{Sync: policy})
+		if err := w.Append(btree.Item{PK: 1, Row: btree.Row{"v": "x"}}); err != nil {
+			t.Fatal(err)
+		}
+		// another process (or this one after a crash) sees it without a Sync
+		if got, err := replayAll(t, path); err != nil || len(got) != 1 {
+			t.Fatalf("%v: replayed %d records before Close, %v", policy, len(got), err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWALIntervalSyncsWhenIdle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, _ := openAll(t, path, WALOptions{Sync: SyncInterval, SyncEvery: 5 * time.Millisecond})
+	defer w.Close()
+	if err := w.Append(btree.Item{PK: 1, Row: btree.Row{"v": "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	// no more appends come, and the record still gets synced
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.mu.Lock()
+		dirty := w.dirty
+		w.mu.Unlock()
+		if !dirty {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("an idle log was not synced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWALStringKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+	w, err := CreateWALOf[string](path, WALOptions{Sync: SyncInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(btree.ItemOf[string]{PK: "k", Row: btree.Row{"z": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got []btree.ItemOf[string]
+	err = ReplayWALOf(path, func(it btree.ItemOf[string]) error {
+		got = append(got, it)
+		return nil
+	})
+	if err != nil || len(got) != 1 || got[0].PK != "k" || got[0].Row["z"] != "1" {
+		t.Fatalf("replayed %v, %v", got, err)
+	}
+}
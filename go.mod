@@ -2,6 +2,10 @@ module SpeedyDb
 
 go 1.25
 
-require github.com/go-sql-driver/mysql v1.9.3
+require (
+	github.com/go-sql-driver/mysql v1.9.3
+	github.com/klauspost/compress v1.20.1
+	github.com/pierrec/lz4/v4 v4.1.30
+)
 
 require filippo.io/edwards25519 v1.1.0 // indirect
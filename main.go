@@ -3,12 +3,15 @@ package main
 import (
 	"SpeedyDb/btree"
 	"SpeedyDb/btreeWriting"
+	"SpeedyDb/segmentStore"
 	"SpeedyDb/structuredDB"
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"log/slog"
 	"math"
@@ -16,6 +19,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -23,10 +27,34 @@ import (
 
 var filePaths []string
 
-var currentMapSize uint64
-var minKey, maxKey int
-var setMinMaxKey = false
-var tr = btree.New(32)
+var segmentCompression = btreeWriting.CompressionNone
+
+// segmentFields seeds each new file's field dictionary, which also fixes the
+// order fields are encoded in: the manifest's RowOrder, or else the JSON key
+// order of the first imported row.
+var segmentFields []string
+
+// packRows stores imported rows as btree.PackedRow against the table's schema
+// instead of as maps, which takes a fraction of the memory.
+var packRows = true
+
+// useWAL logs every write to the in-memory tree to a write-ahead log in the
+// data directory, so rows that are not in a segment yet survive a crash.
+var useWAL = true
+var walSync = btreeWriting.SyncInterval
+
+const (
+	// walName is the log of the tree being filled.
+	walName = "SpeedyDb.wal"
+	// walFlushingName is the log of the tree a background flush is writing
+	// out. It is deleted once the flush's segments are in the catalog.
+	walFlushingName = "SpeedyDb.wal.flushing"
+)
+
+// primaryKeyFields names the fields that make up the primary key, in key
+// order. Empty means the first field of each row; more than one makes a
+// composite key (see btreeWriting.AppendCompositeInt).
+var primaryKeyFields []string
 
 type Pair struct {
 	Key string
@@ -38,24 +66,145 @@ type SeekPoints struct {
 	End   uint32 `json:"end"`
 }
 
+// table holds the in-memory tree and the on-disk segments for one primary key
+// type: int64 (the default) or string, picked with -key.
+type table[K btreeWriting.Key] struct {
+	tr        *btree.BTreeOf[K]
+	catalog   *segmentStore.CatalogOf[K]
+	toKey     func(any) (K, error)
+	formatKey func(K) string
+
+	// flagKey converts a key given on the command line; nil means toKey.
+	flagKey func(string) (K, error)
+
+	minKey, maxKey K
+	setMinMaxKey   bool
+
+	// schema names the columns of packed rows: segmentFields, extended by
+	// any column seen since.
+	schema *btree.Schema
+
+	// wal logs the writes to tr; nil with -wal=false. walDir holds it and
+	// the log of the tree being flushed.
+	wal    *btreeWriting.WALOf[K]
+	walDir string
+
+	// flushing is the tree the background flush in progress is writing out,
+	// and flushDone delivers its outcome; both nil when none is running.
+	// Until its segments are in the catalog, reads find its rows here.
+	flushing  *btree.BTreeOf[K]
+	flushDone chan flushResult
+}
+
+func newTable[K btreeWriting.Key](toKey func(any) (K, error), formatKey func(K) string) *table[K] {
+	return &table[K]{
+		tr:        btree.NewOf[K](32),
+		catalog:   &segmentStore.CatalogOf[K]{},
+		toKey:     toKey,
+		formatKey: formatKey,
+	}
+}
+
 type Manifest struct {
 	BytesPerRow uint64                `json:"BytesPerRow"`
 	RowOrder    []string              `json:"RowOrder"`
+	PrimaryKey  []string              `json:"PrimaryKey,omitempty"`
 	SeekMap     map[string]SeekPoints `json:"SeekPoints"`
 }
 
-func createBtree(FilerFolderPath string) {
+func (t *table[K]) createBtree(FilerFolderPath string) {
+	// segments a crash left half-written never got a .spdb name
+	if err := segmentStore.RemoveTempFiles(FilerFolderPath); err != nil {
+		slog.Error("operation failed", "err", err)
+		os.Exit(1)
+	}
 	files, err := os.ReadDir(FilerFolderPath)
 	if err != nil {
 		slog.Error("operation failed", "err", err)
 		os.Exit(1)
 	}
 
+	filePaths = filePaths[:0]
 	for _, file := range files {
 		if !file.IsDir() && strings.HasSuffix(file.Name(), ".spdb") {
 			filePaths = append(filePaths, path.Join(FilerFolderPath, file.Name()))
 		}
 	}
+
+	t.catalog, err = segmentStore.NewCatalogOf[K](filePaths)
+	if err != nil {
+		slog.Error("operation failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// firstKey returns the lowest key in memory or, failing that, the lowest key
+// of some segment: a sample of what stored keys look like.
+func (t *table[K]) firstKey() (K, bool) {
+	if it, ok := t.tr.IterAscend().Next(); ok {
+		return it.PK, true
+	}
+	if segs := t.catalog.Segments(); len(segs) > 0 {
+		return segs[0].MinPK, true
+	}
+	var zero K
+	return zero, false
+}
+
+// getRow looks pk up in the in-memory tree first, then in the tree being
+// flushed, then in the on-disk segments. A tombstone in a tree hides the key
+// in everything older as well.
+func (t *table[K]) getRow(pk K) (btree.Row, bool, error) {
+	for _, tr := range []*btree.BTreeOf[K]{t.tr, t.flushing} {
+		if tr == nil {
+			continue
+		}
+		if it, ok := tr.GetItem(pk); ok {
+			if it.Deleted {
+				return nil, false, nil
+			}
+			return it.Fields(), true, nil
+		}
+	}
+	return t.catalog.Get(pk)
+}
+
+// compactAll merges every catalogued segment into a single file in dir.
+func (t *table[K]) compactAll(dir string) error {
+	var paths []string
+	for _, seg := range t.catalog.Segments() {
+		paths = append(paths, seg.Path)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	out, ok, err := t.catalog.Compact(paths, dir, segmentWriterOptions())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Printf("compacted %d files, nothing left\n", len(paths))
+		return nil
+	}
+	fmt.Printf("compacted %d files into %s\n", len(paths), out.Path)
+	return nil
+}
+
+// printRange prints every row with lo <= PK < hi from memory and disk, in PK order.
+// Nothing writes to t.tr while it runs, and the flush only reads t.flushing, so
+// the scan can read both directly.
+func (t *table[K]) printRange(lo, hi K) error {
+	it := t.catalog.ScanTrees([]*btree.BTreeOf[K]{t.tr, t.flushing}, lo, hi)
+	defer it.Close()
+	for {
+		item, ok := it.Next()
+		if !ok {
+			break
+		}
+		out, _ := json.Marshal(item.Fields())
+		fmt.Printf("%s: %s\n", t.formatKey(item.PK), out)
+	}
+	return it.Err()
 }
 
 func printDecodeContext(dec *json.Decoder, data []byte, msg string) {
@@ -119,28 +268,37 @@ func readOrderedObject(dec *json.Decoder, data []byte) ([]Pair, error) {
 	return pairs, nil
 }
 
-func ToInt(v any) (int, error) {
+// ToInt64 converts a decoded primary key to int64, rejecting fractions and
+// values outside the int64 range rather than truncating them.
+func ToInt64(v any) (int64, error) {
 	switch x := v.(type) {
 	case int:
+		return int64(x), nil
+
+	case int64:
 		return x, nil
 
 	case json.Number:
 		i64, err := x.Int64()
 		if err != nil {
-			return 0, fmt.Errorf("json.Number not an int: %w", err)
+			return 0, fmt.Errorf("json.Number not an int64: %w", err)
 		}
-		return int(i64), nil
+		return i64, nil
 
 	case float64:
 		if math.Trunc(x) != x {
 			return 0, fmt.Errorf("float64 is not an integer: %v", x)
 		}
-		return int(x), nil
+		// -2^63 is exact in float64; 2^63 is the first value past MaxInt64
+		if x < math.MinInt64 || x >= math.MaxInt64 {
+			return 0, fmt.Errorf("float64 out of int64 range: %v", x)
+		}
+		return int64(x), nil
 
 	case string:
-		i, err := strconv.Atoi(x)
+		i, err := strconv.ParseInt(x, 10, 64)
 		if err != nil {
-			return 0, fmt.Errorf("string not an int: %w", err)
+			return 0, fmt.Errorf("string not an int64: %w", err)
 		}
 		return i, nil
 
@@ -149,87 +307,421 @@ func ToInt(v any) (int, error) {
 	}
 }
 
-func renameFile(oldPath, newPath string) error {
-	return os.Rename(oldPath, newPath)
+// ToCompositeKey encodes the []any of key field values of an imported row as a
+// composite primary key.
+func ToCompositeKey(v any) (string, error) {
+	parts, ok := v.([]any)
+	if !ok {
+		return "", fmt.Errorf("unsupported type %T", v)
+	}
+
+	var key []byte
+	for i, part := range parts {
+		if s, ok := part.(string); ok {
+			key = btreeWriting.AppendCompositeString(key, s)
+			continue
+		}
+		n, err := ToInt64(part)
+		if err != nil {
+			return "", fmt.Errorf("key part %d: %w", i, err)
+		}
+		key = btreeWriting.AppendCompositeInt(key, n)
+	}
+	return string(key), nil
+}
+
+// CompositeKeyFromFlag encodes a composite key given on the command line as
+// comma-separated parts. Each part takes the type of the same part of like, a
+// key already stored, so "7,42" finds a row whose second key field is the
+// string "42". With nothing stored (like is "") there is nothing to match, and
+// parts that parse as integers are taken as integers.
+func CompositeKeyFromFlag(s, like string) (string, error) {
+	strs := strings.Split(s, ",")
+	parts := make([]any, len(strs))
+	if like == "" {
+		for i, str := range strs {
+			if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+				parts[i] = n
+			} else {
+				parts[i] = str
+			}
+		}
+		return ToCompositeKey(parts)
+	}
+
+	kinds, err := btreeWriting.DecodeCompositeKey(like)
+	if err != nil {
+		return "", err
+	}
+	if len(kinds) != len(strs) {
+		return "", fmt.Errorf("key %q has %d parts, want %d", s, len(strs), len(kinds))
+	}
+	for i, kind := range kinds {
+		if _, isInt := kind.(int64); !isInt {
+			parts[i] = strs[i]
+			continue
+		}
+		n, err := strconv.ParseInt(strs[i], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("key part %d: %w", i, err)
+		}
+		parts[i] = n
+	}
+	return ToCompositeKey(parts)
+}
+
+// FormatCompositeKey renders a composite key as its comma-separated parts.
+func FormatCompositeKey(k string) string {
+	parts, err := btreeWriting.DecodeCompositeKey(k)
+	if err != nil {
+		return strconv.Quote(k)
+	}
+	strs := make([]string, len(parts))
+	for i, part := range parts {
+		strs[i] = fmt.Sprint(part)
+	}
+	return strings.Join(strs, ",")
+}
+
+func formatAnyKey[K btreeWriting.Key](k K) string {
+	return fmt.Sprint(k)
+}
+
+// isPrimaryKeyField reports whether the field at index with the given name is
+// part of the primary key, and so kept out of the stored row.
+func isPrimaryKeyField(index int, name string) bool {
+	if len(primaryKeyFields) == 0 {
+		return index == 0
+	}
+	return slices.Contains(primaryKeyFields, name)
+}
+
+// primaryKeyValue picks the primary key out of a row: the first field, the one
+// named key field, or a []any of every key field for a composite key.
+func primaryKeyValue(pairs []Pair) (any, error) {
+	if len(primaryKeyFields) == 0 {
+		if len(pairs) == 0 {
+			return nil, errors.New("empty row has no primary key")
+		}
+		return pairs[0].Val, nil
+	}
+
+	parts := make([]any, len(primaryKeyFields))
+	for i, name := range primaryKeyFields {
+		j := slices.IndexFunc(pairs, func(p Pair) bool { return p.Key == name })
+		if j < 0 {
+			return nil, fmt.Errorf("row has no primary key field %q", name)
+		}
+		parts[i] = pairs[j].Val
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return parts, nil
+}
+
+// ToKeyString accepts a string primary key (UUIDs, codes, ...) as is. Numbers
+// are rejected rather than stringified, since "10" sorts before "9".
+func ToKeyString(v any) (string, error) {
+	switch x := v.(type) {
+	case string:
+		return x, nil
+
+	case json.Number:
+		return "", fmt.Errorf("numeric key %s with -key=string (use -key=int)", x)
+
+	default:
+		return "", fmt.Errorf("unsupported type %T", v)
+	}
 }
 
-func createNewWriter(path string) (*btreeWriting.Writer, error) {
+func createNewWriter[K btreeWriting.Key](path string) (*btreeWriting.WriterOf[K], error) {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
 	if err != nil {
 		return nil, err
 	}
-	return btreeWriting.NewWriter(f), nil
+	return btreeWriting.NewWriterOf[K](f, segmentWriterOptions()), nil
 }
 
-func iteratorWriter(it *btree.Iter, spw *btreeWriting.Writer, breakAtBytes uint64) int {
-	for {
+func segmentWriterOptions() btreeWriting.WriterOptions {
+	return btreeWriting.WriterOptions{
+		Checksum:    btreeWriting.ChecksumBlock,
+		Compression: segmentCompression,
+		Fields:      segmentFields,
+		Sync:        true,
+	}
+}
+
+// writeSegment writes up to limit items (0 = all) from it to a new segment in
+// dir, named with sequence number seq, and returns its path, or "" if it had
+// no items left. The file is written under a temp name, synced, and only then
+// given its final name by segmentStore.CommitFile, which never replaces an
+// existing segment.
+func writeSegment[K btreeWriting.Key](it *btree.IterOf[K], limit int, dir string, seq uint64) (string, error) {
+	first, ok := it.Next()
+	if !ok {
+		return "", nil
+	}
+	tmpPath := filepath.Join(dir, segmentStore.TempName(seq, "flush"))
+	spw, err := createNewWriter[K](tmpPath)
+	if err != nil {
+		return "", err
+	}
+
+	last := first
+	for written := 1; ; written++ {
+		if err := spw.WriteItem(last); err != nil {
+			_ = spw.Close()
+			_ = os.Remove(tmpPath)
+			return "", err
+		}
+		if written == limit {
+			break
+		}
 		item, ok := it.Next()
 		if !ok {
-			_ = spw.Close()
 			break
 		}
+		last = item
+	}
+	if err := spw.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
 
-		if writeErr := spw.WriteItem(item); writeErr != nil {
-			slog.Error("operation failed", "err", writeErr)
-			closeWriterErr := spw.Close()
-			if closeWriterErr != nil {
-				slog.Error("operation failed", "err", closeWriterErr)
-			}
+	finalPath := filepath.Join(dir, segmentStore.SegmentName(first.PK, last.PK, seq))
+	if err := segmentStore.CommitFile(tmpPath, finalPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	return finalPath, nil
+}
+
+func (t *table[K]) resetInMemoryState() {
+	t.tr = btree.NewOf[K](32)
+	t.setMinMaxKey = false
+	var zero K
+	t.minKey, t.maxKey = zero, zero
+}
+
+// writeMapToFile hands the in-memory tree to a background flush and starts a
+// fresh one, so ingestion only waits if the previous flush is still running.
+// At most two trees are in memory at once. An error is from the previous flush.
+func (t *table[K]) writeMapToFile(storagePath string) error {
+	if err := t.waitForFlush(); err != nil {
+		return err
+	}
+
+	frozen := t.tr
+	t.resetInMemoryState()
+	if t.wal != nil {
+		if err := t.rotateWAL(); err != nil {
+			return err
 		}
+	}
 
-		if spw.BytesWritten >= breakAtBytes && breakAtBytes != 0 {
-			_ = spw.Close()
-			return item.PK
+	done := make(chan flushResult, 1)
+	t.flushing = frozen
+	t.flushDone = done
+	nextSeq := t.catalog.NextSeq
+	go func() {
+		paths, err := flushTree(frozen, storagePath, nextSeq)
+		done <- flushResult{paths, err}
+	}()
+	return nil
+}
+
+type flushResult struct {
+	paths []string
+	err   error
+}
+
+// waitForFlush waits for the background flush, if any, and adds the files it
+// wrote to the catalog. The log of the flushed tree is only deleted if all of
+// that worked; otherwise the next start replays it and flushes again.
+func (t *table[K]) waitForFlush() error {
+	if t.flushDone == nil {
+		return nil
+	}
+	res := <-t.flushDone
+	t.flushDone = nil
+	if res.err != nil {
+		return fmt.Errorf("flush: %w", res.err)
+	}
+	for _, p := range res.paths {
+		if err := t.catalog.Add(p); err != nil {
+			return err
 		}
 	}
-	return 0
+	t.flushing = nil
+	if t.wal != nil {
+		// the flushed rows are on disk now, so their log can go
+		err := os.Remove(filepath.Join(t.walDir, walFlushingName))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return segmentStore.SyncDir(t.walDir)
+	}
+	return nil
 }
 
-func resetInMemoryState() {
-	tr = btree.New(32)
-	currentMapSize = 0
-	setMinMaxKey = false
-	minKey, maxKey = 0, 0
+func walOptions() btreeWriting.WALOptions {
+	return btreeWriting.WALOptions{Sync: walSync, Fields: segmentFields}
 }
 
-func writeMapToFile(storagePath string, MaxMemorySize uint64) {
-	HalfMemorySize := MaxMemorySize / 2
-	lowerFile := filepath.Join(storagePath, fmt.Sprintf("%d_%s.spdb", minKey, "lower"))
+// openWAL rebuilds the in-memory tree from the logs in dir and opens the log
+// for appending. A flushing log left behind means a flush never finished:
+// its rows are written out again now, so it can go before a new flush needs
+// the name.
+func (t *table[K]) openWAL(dir string) error {
+	t.walDir = dir
+	flushing := filepath.Join(dir, walFlushingName)
+	if err := btreeWriting.ReplayWALOf(flushing, t.replayItem); err != nil {
+		return err
+	}
+	wal, err := btreeWriting.OpenWALOf(filepath.Join(dir, walName), walOptions(), t.replayItem)
+	if err != nil {
+		return err
+	}
+	t.wal = wal
 
-	spw, createWriterError := createNewWriter(lowerFile)
-	if createWriterError != nil {
-		slog.Error("operation failed", "err", createWriterError)
+	if _, err := os.Stat(flushing); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if t.tr.Len() > 0 {
+		paths, err := flushTree(t.tr, dir, t.catalog.NextSeq)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if err := t.catalog.Add(p); err != nil {
+				return err
+			}
+		}
+		t.resetInMemoryState()
+	}
+	// The flushing log goes first: were the active one emptied while the
+	// flushing one was still there, a crash would replay only the older rows.
+	if err := os.Remove(flushing); err != nil {
+		return err
+	}
+	if err := segmentStore.SyncDir(dir); err != nil {
+		return err
+	}
+	if err := t.wal.Close(); err != nil {
+		return err
+	}
+	t.wal, err = btreeWriting.CreateWALOf[K](filepath.Join(dir, walName), walOptions())
+	return err
+}
+
+// replayItem puts a logged write back into the in-memory tree.
+func (t *table[K]) replayItem(it btree.ItemOf[K]) error {
+	if packRows && !it.Deleted {
+		t.initSchema()
+		packed, schema, err := btree.PackMap(t.schema, it.Row)
+		if err != nil {
+			return err
+		}
+		t.schema = schema
+		it = btree.ItemOf[K]{PK: it.PK, Packed: packed}
+	}
+	t.noteKey(it.PK)
+	t.tr.Upsert(it)
+	return nil
+}
+
+// rotateWAL sets the log aside for the flush that is starting and begins a
+// new one. Only one flush runs at a time, so the flushing name is free.
+func (t *table[K]) rotateWAL() error {
+	if err := t.wal.Close(); err != nil {
+		return err
+	}
+	active := filepath.Join(t.walDir, walName)
+	if err := os.Rename(active, filepath.Join(t.walDir, walFlushingName)); err != nil {
+		return err
+	}
+	if err := segmentStore.SyncDir(t.walDir); err != nil {
+		return err
 	}
+	var err error
+	t.wal, err = btreeWriting.CreateWALOf[K](active, walOptions())
+	return err
+}
 
+// flushTree writes tr to one or two segment files, split at the median key so
+// they hold the same number of rows, and returns their paths. Each file is
+// named with a number from nextSeq, so it shadows every older segment. tr must
+// not change meanwhile. A segment only gets its final name once it is whole on
+// disk; after an error, a file that did make it is valid but holds only part
+// of tr.
+func flushTree[K btreeWriting.Key](tr *btree.BTreeOf[K], storagePath string, nextSeq func() uint64) ([]string, error) {
 	it := tr.IterAscend()
-	// first file
-	minSplitMax := iteratorWriter(it, spw, HalfMemorySize)
-	finalLower := filepath.Join(storagePath, fmt.Sprintf("%d_%d.spdb", minKey, minSplitMax))
-	_ = renameFile(lowerFile, finalLower)
+	var paths []string
+	// first file: everything below the median, then the rest
+	for _, limit := range []int{(tr.Len() + 1) / 2, 0} {
+		p, err := writeSegment(it, limit, storagePath, nextSeq())
+		if err != nil {
+			return paths, err
+		}
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
 
-	// second file
-	item, ok := it.Next()
-	if !ok {
-		resetInMemoryState()
-		return
+// newItem builds the tree item for one imported row, leaving out the primary
+// key fields.
+func (t *table[K]) newItem(pk K, pairs []Pair) (btree.ItemOf[K], error) {
+	if !packRows {
+		row := make(btree.Row, len(pairs))
+		for index, pair := range pairs {
+			if !isPrimaryKeyField(index, pair.Key) {
+				row[pair.Key] = pair.Val
+			}
+		}
+		return btree.ItemOf[K]{PK: pk, Row: row}, nil
 	}
-	maxSplitMin := item.PK
-	upperFile := filepath.Join(storagePath, fmt.Sprintf("%d_%d.spdb", maxSplitMin, maxKey))
-	spw, createWriterError = createNewWriter(upperFile)
-	if createWriterError != nil {
-		slog.Error("operation failed", "err", createWriterError)
+
+	t.initSchema()
+	names := make([]string, 0, len(pairs))
+	vals := make([]any, 0, len(pairs))
+	for index, pair := range pairs {
+		if !isPrimaryKeyField(index, pair.Key) {
+			t.schema = t.schema.With(pair.Key)
+			names = append(names, pair.Key)
+			vals = append(vals, pair.Val)
+		}
 	}
-	// write the item we just gathered
-	if writeErr := spw.WriteItem(item); writeErr != nil {
-		slog.Error("operation failed", "err", writeErr)
-		_ = spw.Close()
+	packed, err := btree.PackRow(t.schema, names, vals)
+	if err != nil {
+		return btree.ItemOf[K]{}, err
 	}
-	_ = iteratorWriter(it, spw, 0)
+	return btree.ItemOf[K]{PK: pk, Packed: packed}, nil
+}
 
-	resetInMemoryState()
+func (t *table[K]) initSchema() {
+	if t.schema == nil {
+		t.schema = btree.NewSchema(segmentFields)
+	}
 }
 
-func importDataFromFile(filePath string, MaxMemorySize uint64, storagePath string) {
+// noteKey widens the tree's key range to take in pk.
+func (t *table[K]) noteKey(pk K) {
+	if !t.setMinMaxKey {
+		t.minKey, t.maxKey = pk, pk
+		t.setMinMaxKey = true
+	}
+	if pk < t.minKey {
+		t.minKey = pk
+	}
+	if pk > t.maxKey {
+		t.maxKey = pk
+	}
+}
+
+func (t *table[K]) importDataFromFile(filePath string, MaxMemorySize uint64, storagePath string) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		slog.Error("operation failed", "err", err)
@@ -237,29 +729,16 @@ func importDataFromFile(filePath string, MaxMemorySize uint64, storagePath strin
 	}
 	defer file.Close()
 
-	info, err := file.Stat()
-	if err != nil {
-		slog.Error("operation failed", "err", err)
-	}
-	sizeBytes := uint64(info.Size())
-
-	writeToDisk := false
-	if sizeBytes > MaxMemorySize {
-		writeToDisk = true
-	}
+	// A flush keeps the full tree alive until it is on disk while the next
+	// one fills, so each may use only half of the limit.
+	treeBudget := MaxMemorySize / 2
+	flushed := false
 
 	scanner := bufio.NewScanner(file)
 	scanner.Buffer(make([]byte, 1024), 10*1024*1024)
-	var lineSize uint64
 	for scanner.Scan() {
 		line := scanner.Bytes()
 
-		if writeToDisk {
-			lineSize = uint64(len(line))
-			if lineSize+currentMapSize > MaxMemorySize {
-				writeMapToFile(storagePath, MaxMemorySize)
-			}
-		}
 		dec := json.NewDecoder(bytes.NewReader(line))
 
 		pairs, readOrderedError := readOrderedObject(dec, line)
@@ -268,44 +747,70 @@ func importDataFromFile(filePath string, MaxMemorySize uint64, storagePath strin
 			os.Exit(1)
 		}
 
-		var PrimaryKey int
-		var tempMap = map[string]any{}
-		for index, pair := range pairs {
-			// primary key check
-			if index == 0 {
-				i, convertPKError := ToInt(pair.Val)
-				if convertPKError != nil {
-					slog.Error("operation failed", "err", convertPKError)
+		if segmentFields == nil {
+			segmentFields = make([]string, 0, len(pairs))
+			for index, pair := range pairs {
+				if !isPrimaryKeyField(index, pair.Key) {
+					segmentFields = append(segmentFields, pair.Key)
 				}
-				PrimaryKey = i
+			}
+		}
 
-				if !setMinMaxKey {
-					minKey = PrimaryKey
-					maxKey = PrimaryKey
-					setMinMaxKey = true
-				}
-				if PrimaryKey < minKey {
-					minKey = PrimaryKey
-				}
-				if PrimaryKey > maxKey {
-					maxKey = PrimaryKey
-				}
-			} else {
-				tempMap[pair.Key] = pair.Val
+		// primary key check
+		keyVal, keyErr := primaryKeyValue(pairs)
+		if keyErr != nil {
+			slog.Error("operation failed", "err", keyErr, "file", filePath, "line", string(line))
+			os.Exit(1)
+		}
+		PrimaryKey, convertPKError := t.toKey(keyVal)
+		if convertPKError != nil {
+			slog.Error("operation failed", "err", convertPKError, "file", filePath, "line", string(line))
+			os.Exit(1)
+		}
+		t.noteKey(PrimaryKey)
+
+		item, itemErr := t.newItem(PrimaryKey, pairs)
+		if itemErr != nil {
+			slog.Error("operation failed", "err", itemErr, "file", filePath, "line", string(line))
+			os.Exit(1)
+		}
+		if t.wal != nil {
+			if walErr := t.wal.Append(item); walErr != nil {
+				slog.Error("operation failed", "err", walErr, "file", filePath, "line", string(line))
+				os.Exit(1)
 			}
 		}
-		tr.Upsert(btree.Item{PK: PrimaryKey, Row: tempMap})
-		if writeToDisk {
-			currentMapSize += lineSize
+		t.tr.Upsert(item)
+		if t.tr.Bytes() > treeBudget {
+			if flushErr := t.writeMapToFile(storagePath); flushErr != nil {
+				slog.Error("operation failed", "err", flushErr)
+				os.Exit(1)
+			}
+			flushed = true
 		}
 	}
-	if writeToDisk {
-		if tr.Len() > 0 {
-			writeMapToFile(storagePath, MaxMemorySize)
+	if flushed {
+		var flushErr error
+		if t.tr.Len() > 0 {
+			flushErr = t.writeMapToFile(storagePath)
+		}
+		if flushErr == nil {
+			flushErr = t.waitForFlush()
+		}
+		if flushErr != nil {
+			slog.Error("operation failed", "err", flushErr)
+			os.Exit(1)
+		}
+	}
+	if t.wal != nil {
+		// rows left in memory are only as safe as the log
+		if syncErr := t.wal.Sync(); syncErr != nil {
+			slog.Error("operation failed", "err", syncErr)
+			os.Exit(1)
 		}
 	}
 
-	fmt.Println("Current Map Size: {:%d}", currentMapSize, minKey, maxKey)
+	fmt.Printf("Current Map Size: %d, minKey: %s, maxKey: %s\n", t.tr.Bytes(), t.formatKey(t.minKey), t.formatKey(t.maxKey))
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -317,8 +822,67 @@ func importDataFromFile(filePath string, MaxMemorySize uint64, storagePath strin
 	fmt.Printf("NumGC = %d\n", m.NumGC)
 }
 
-func determineSeekPoints(user string, password string, url string, port string, schema string, table string) (rowBytes uint64, orderSlice []string, seekMap map[string]SeekPoints) {
-	rowBytes, columnSizeMap, orderSlice, err := structuredDB.GetRowSizeSQL(user, password, url, port, schema, table)
+// runCommands loads the segment catalog and runs -get, -compact or -scan if
+// one was given. done=true means a command ran and main should exit.
+func (t *table[K]) runCommands(DataStoragePath, getPK, scanRange string, compact bool) (done bool) {
+	if DataStoragePath != "" {
+		t.createBtree(DataStoragePath)
+		if useWAL {
+			if walErr := t.openWAL(DataStoragePath); walErr != nil {
+				log.Fatalf("wal: %v", walErr)
+			}
+		}
+	}
+	flagKey := t.flagKey
+	if flagKey == nil {
+		flagKey = func(s string) (K, error) { return t.toKey(s) }
+	}
+
+	if getPK != "" {
+		pk, convertPKError := flagKey(getPK)
+		if convertPKError != nil {
+			log.Fatalf("get: %v", convertPKError)
+		}
+		row, ok, getErr := t.getRow(pk)
+		if getErr != nil {
+			log.Fatalf("get: %v", getErr)
+		}
+		if !ok {
+			fmt.Println("not found:", t.formatKey(pk))
+			return true
+		}
+		out, _ := json.Marshal(row)
+		fmt.Printf("%s: %s\n", t.formatKey(pk), out)
+		return true
+	}
+
+	if compact {
+		if compactErr := t.compactAll(DataStoragePath); compactErr != nil {
+			log.Fatalf("compact: %v", compactErr)
+		}
+		return true
+	}
+
+	if scanRange != "" {
+		loStr, hiStr, found := strings.Cut(scanRange, ":")
+		if !found {
+			log.Fatalf("scan: expected lo:hi, got %q", scanRange)
+		}
+		lo, loErr := flagKey(loStr)
+		hi, hiErr := flagKey(hiStr)
+		if loErr != nil || hiErr != nil {
+			log.Fatalf("scan: bad range %q", scanRange)
+		}
+		if scanErr := t.printRange(lo, hi); scanErr != nil {
+			log.Fatalf("scan: %v", scanErr)
+		}
+		return true
+	}
+	return false
+}
+
+func determineSeekPoints(user string, password string, url string, port string, schema string, table string) (rowBytes uint64, orderSlice []string, seekMap map[string]SeekPoints, pkColumns []string) {
+	rowBytes, columnSizeMap, orderSlice, pkColumns, err := structuredDB.GetRowSizeSQL(user, password, url, port, schema, table)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -338,12 +902,30 @@ func determineSeekPoints(user string, password string, url string, port string,
 	}
 
 	fmt.Println("Row Size: ", rowBytes, ", Column Size: ", columnSizeMap, ", Order Slice: ", orderSlice, ", seekMap: ", seekMap)
-	return rowBytes, orderSlice, seekMap
+	return rowBytes, orderSlice, seekMap, pkColumns
+}
+
+func manifestPath(workingDirectory string, tableName string) string {
+	return filepath.Join(workingDirectory, fmt.Sprintf("%s_manifest.json", tableName))
+}
+
+// readManifest reads the manifest an earlier run wrote for tableName. A
+// missing manifest reads as an empty one.
+func readManifest(workingDirectory string, tableName string) (Manifest, error) {
+	var m Manifest
+	b, err := os.ReadFile(manifestPath(workingDirectory, tableName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(b, &m)
 }
 
-func createManifest(rowBytes uint64, orderSlice []string, seekMap map[string]SeekPoints, workingDirectory string, tableName string) (string, error) {
+func createManifest(rowBytes uint64, orderSlice []string, seekMap map[string]SeekPoints, pkColumns []string, workingDirectory string, tableName string) (string, error) {
 	f, err := os.OpenFile(
-		filepath.Join(workingDirectory, fmt.Sprintf("%s_manifest.json", tableName)),
+		manifestPath(workingDirectory, tableName),
 		os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
 		0o644,
 	)
@@ -358,6 +940,7 @@ func createManifest(rowBytes uint64, orderSlice []string, seekMap map[string]See
 	m := Manifest{
 		BytesPerRow: rowBytes,
 		RowOrder:    orderSlice,
+		PrimaryKey:  pkColumns,
 		SeekMap:     seekMap,
 	}
 
@@ -386,8 +969,36 @@ func main() {
 	port := flag.String("port", "3306", "Port for database extraction")
 	schema := flag.String("schema", "benchdb", "Schema for database extraction")
 	table := flag.String("table", "big10g", "Table for database extraction")
+	getPK := flag.String("get", "", "Print the row stored for this primary key and exit")
+	scanRange := flag.String("scan", "", "Print rows with lo <= primary key < hi, given as lo:hi, and exit")
+	compression := flag.String("compression", "none", "Block compression for new .spdb files: none, snappy, zstd or lz4")
+	compact := flag.Bool("compact", false, "Merge all .spdb files into one, dropping deleted rows, and exit")
+	keyType := flag.String("key", "int", "Primary key type: int (64-bit integer) or string")
+	walFlag := flag.Bool("wal", true, "Log writes to the in-memory tree to SpeedyDb.wal in the data directory and replay it on startup")
+	walSyncFlag := flag.String("wal-sync", "interval", "When to fsync the write-ahead log: always (every write), interval (every second while there are unsynced writes) or none (leave it to the OS)")
+	packed := flag.Bool("packed", true, "Hold imported rows in a compact packed form instead of maps. Turn off to compare memory use")
+	pkFields := flag.String("pk", "", "Comma-separated primary key fields, e.g. tenant_id,order_id. More than one makes a composite key and overrides -key. Default: the first field of each row")
 
 	flag.Parse()
+
+	packRows = *packed
+	useWAL = *walFlag
+	walSync, err = btreeWriting.ParseSyncPolicy(*walSyncFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	segmentCompression, err = btreeWriting.ParseCompression(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *keyType != "int" && *keyType != "string" {
+		log.Fatalf("unknown -key %q (want int or string)", *keyType)
+	}
+	if *pkFields != "" {
+		for _, name := range strings.Split(*pkFields, ",") {
+			primaryKeyFields = append(primaryKeyFields, strings.TrimSpace(name))
+		}
+	}
 	//uds := flag.String("uds", "/tmp/kvdb.sock", "UDS socket path")
 	//shards := flag.Int("shards", 64, "number of shards")
 	//debug := flag.Bool("debug", false, "enable debug logging")
@@ -412,12 +1023,50 @@ func main() {
 		"max_memory_size", *MaxMemorySize,
 	)
 
-	if *DataStoragePath != "" {
-		createBtree(*DataStoragePath)
+	// The key fields pick the table's key type, so they are settled first:
+	// from -pk, else the database when importing, else the manifest that
+	// import left behind.
+	tableName := fmt.Sprintf("%s_%s", *schema, *table)
+	command := *getPK != "" || *scanRange != "" || *compact
+	var rowBytes uint64
+	var orderSlice []string
+	var seekMap map[string]SeekPoints
+	var pkColumns []string
+	if command {
+		if primaryKeyFields == nil {
+			m, manifestErr := readManifest(*DataStoragePath, tableName)
+			if manifestErr != nil {
+				log.Fatalf("manifest: %v", manifestErr)
+			}
+			primaryKeyFields = m.PrimaryKey
+		}
+	} else {
+		rowBytes, orderSlice, seekMap, pkColumns = determineSeekPoints(*user, *password, *url, *port, *schema, *table)
+		segmentFields = orderSlice
+		if primaryKeyFields == nil {
+			primaryKeyFields = pkColumns
+		}
+	}
+
+	var done bool
+	switch {
+	case len(primaryKeyFields) > 1:
+		t := newTable(ToCompositeKey, FormatCompositeKey)
+		t.flagKey = func(s string) (string, error) {
+			like, _ := t.firstKey()
+			return CompositeKeyFromFlag(s, like)
+		}
+		done = t.runCommands(*DataStoragePath, *getPK, *scanRange, *compact)
+	case *keyType == "string":
+		done = newTable(ToKeyString, formatAnyKey[string]).runCommands(*DataStoragePath, *getPK, *scanRange, *compact)
+	default:
+		done = newTable(ToInt64, formatAnyKey[int64]).runCommands(*DataStoragePath, *getPK, *scanRange, *compact)
+	}
+	if done {
+		return
 	}
 
-	rowBytes, orderSlice, seekMap := determineSeekPoints(*user, *password, *url, *port, *schema, *table)
-	manifestFile, createManifestError := createManifest(rowBytes, orderSlice, seekMap, *DataStoragePath, fmt.Sprintf("%s_%s", *schema, *table))
+	manifestFile, createManifestError := createManifest(rowBytes, orderSlice, seekMap, pkColumns, *DataStoragePath, tableName)
 	if createManifestError != nil {
 		slog.Error("operation failed", "err", createManifestError)
 	}
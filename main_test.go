@@ -0,0 +1,423 @@
+package main
+
+import (
+	"SpeedyDb/btree"
+	"SpeedyDb/btreeWriting"
+	"SpeedyDb/segmentStore"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// withKeyFields sets primaryKeyFields for one test.
+func withKeyFields(t *testing.T, names ...string) {
+	t.Helper()
+	primaryKeyFields = names
+	t.Cleanup(func() {
+		primaryKeyFields = nil
+		segmentFields = nil
+	})
+}
+
+// writeInput writes lines as a JSON lines file to import.
+func writeInput(t *testing.T, dir string, lines string) string {
+	t.Helper()
+	path := filepath.Join(dir, "in.jsonl")
+	if err := os.WriteFile(path, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCompositeImport(t *testing.T) {
+	withKeyFields(t, "tenant_id", "order_id")
+	dir := t.TempDir()
+	in := writeInput(t, dir, `{"tenant_id":2,"name":"b","order_id":"1"}
+{"tenant_id":1,"name":"a","order_id":"10"}
+{"tenant_id":1,"name":"c","order_id":"9"}
+{"tenant_id":-1,"name":"d","order_id":"42"}
+`)
+
+	// a tiny budget flushes every row to its own segment
+	tb := newTable(ToCompositeKey, FormatCompositeKey)
+	tb.importDataFromFile(in, 100, dir)
+	if tb.catalog.Len() == 0 {
+		t.Fatal("nothing was flushed")
+	}
+
+	like, ok := tb.firstKey()
+	if !ok || FormatCompositeKey(like) != "-1,42" {
+		t.Fatalf("firstKey = %q, %v", FormatCompositeKey(like), ok)
+	}
+	for _, tt := range []struct{ flag, name string }{{"-1,42", "d"}, {"1,10", "a"}, {"1,9", "c"}, {"2,1", "b"}} {
+		pk, err := CompositeKeyFromFlag(tt.flag, like)
+		if err != nil {
+			t.Fatal(err)
+		}
+		row, ok, err := tb.getRow(pk)
+		if err != nil || !ok || row["name"] != tt.name || len(row) != 1 {
+			t.Fatalf("getRow(%s) = %v, %v, %v, want name %s", tt.flag, row, ok, err, tt.name)
+		}
+	}
+
+	// key fields sort column by column, order_id as a string
+	it := tb.catalog.Scan(tb.tr, "", "\xff")
+	defer it.Close()
+	var got []string
+	for {
+		item, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, FormatCompositeKey(item.PK))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-1,42", "1,10", "1,9", "2,1"}; !slices.Equal(got, want) {
+		t.Fatalf("scan order %q, want %q", got, want)
+	}
+}
+
+func TestCompositeKeyFromFlag(t *testing.T) {
+	like := string(btreeWriting.AppendCompositeString(btreeWriting.AppendCompositeInt(nil, 5), "x"))
+
+	k, err := CompositeKeyFromFlag("7,42", like)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ToCompositeKey([]any{int64(7), "42"})
+	if k != want {
+		t.Fatalf("7,42 encoded as %q, want int then string", FormatCompositeKey(k))
+	}
+
+	for _, bad := range []string{"x,42", "7", "7,42,1"} {
+		if _, err := CompositeKeyFromFlag(bad, like); err == nil {
+			t.Errorf("CompositeKeyFromFlag(%q) accepted a key unlike %q", bad, FormatCompositeKey(like))
+		}
+	}
+
+	// nothing stored yet: integers stay integers
+	k, err = CompositeKeyFromFlag("7,42", "")
+	if want, _ := ToCompositeKey([]any{int64(7), int64(42)}); err != nil || k != want {
+		t.Fatalf("with no stored key 7,42 = %q, %v", FormatCompositeKey(k), err)
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	m, err := readManifest(dir, "db_orders")
+	if err != nil || m.PrimaryKey != nil {
+		t.Fatalf("missing manifest = %+v, %v", m, err)
+	}
+	if _, err := createManifest(16, []string{"tenant_id", "order_id", "name"}, nil, []string{"tenant_id", "order_id"}, dir, "db_orders"); err != nil {
+		t.Fatal(err)
+	}
+	m, err = readManifest(dir, "db_orders")
+	if err != nil || !slices.Equal(m.PrimaryKey, []string{"tenant_id", "order_id"}) {
+		t.Fatalf("manifest = %+v, %v", m, err)
+	}
+}
+
+func TestReadsSeeFlushingTree(t *testing.T) {
+	dir := t.TempDir()
+	tb := newTable(ToInt64, formatAnyKey[int64])
+	for pk := int64(0); pk < 100; pk++ {
+		tb.tr.Upsert(btree.Item{PK: pk, Row: btree.Row{"v": pk}})
+	}
+	if err := tb.writeMapToFile(dir); err != nil {
+		t.Fatal(err)
+	}
+	tb.tr.Upsert(btree.Item{PK: 7, Deleted: true})
+	tb.tr.Upsert(btree.Item{PK: 200, Row: btree.Row{"v": int64(200)}})
+
+	check := func(when string) {
+		t.Helper()
+		for _, pk := range []int64{0, 50, 99, 200} {
+			if row, ok, err := tb.getRow(pk); err != nil || !ok || row["v"] != pk {
+				t.Fatalf("%s: getRow(%d) = %v, %v, %v", when, pk, row, ok, err)
+			}
+		}
+		if _, ok, err := tb.getRow(7); err != nil || ok {
+			t.Fatalf("%s: getRow(7) found a row the live tree deleted", when)
+		}
+
+		it := tb.catalog.ScanTrees([]*btree.BTree{tb.tr, tb.flushing}, 0, 1000)
+		defer it.Close()
+		n := 0
+		for {
+			if _, ok := it.Next(); !ok {
+				break
+			}
+			n++
+		}
+		if err := it.Err(); err != nil || n != 100 {
+			t.Fatalf("%s: scan found %d rows, %v, want 100", when, n, err)
+		}
+	}
+
+	// the flush may or may not have finished, but its rows are not in the
+	// catalog until waitForFlush
+	if tb.flushing == nil {
+		t.Fatal("no flushing tree during a flush")
+	}
+	check("during the flush")
+	if err := tb.waitForFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if tb.flushing != nil {
+		t.Fatal("flushing tree kept after the flush")
+	}
+	check("after the flush")
+}
+
+// reopen starts a table on dir as a new process would.
+func reopen(t *testing.T, dir string) *table[int64] {
+	t.Helper()
+	filePaths = nil
+	tb := newTable(ToInt64, formatAnyKey[int64])
+	if done := tb.runCommands(dir, "", "", false); done {
+		t.Fatal("runCommands ran a command")
+	}
+	return tb
+}
+
+func TestWALRecovery(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() {
+		segmentFields = nil
+		filePaths = nil
+	})
+	in := writeInput(t, dir, `{"id":1,"name":"a"}
+{"id":2,"name":"b"}
+{"id":3,"name":"c"}
+`)
+
+	// an import that fits in memory, then a crash
+	tb := reopen(t, dir)
+	tb.importDataFromFile(in, 1<<30, dir)
+	if tb.catalog.Len() != 0 {
+		t.Fatal("a small import was flushed")
+	}
+
+	tb = reopen(t, dir)
+	if row, ok, err := tb.getRow(2); err != nil || !ok || row["name"] != "b" {
+		t.Fatalf("after replay getRow(2) = %v, %v, %v", row, ok, err)
+	}
+
+	// a crash during a flush leaves the tree's log under the flushing name
+	if err := tb.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, walName), filepath.Join(dir, walFlushingName)); err != nil {
+		t.Fatal(err)
+	}
+	tb = reopen(t, dir)
+	if tb.tr.Len() != 0 || tb.catalog.Len() == 0 {
+		t.Fatalf("recovery left %d rows in memory and %d segments", tb.tr.Len(), tb.catalog.Len())
+	}
+	if _, err := os.Stat(filepath.Join(dir, walFlushingName)); err == nil {
+		t.Fatal("the flushing log was kept after its rows were written out")
+	}
+	if row, ok, err := tb.getRow(3); err != nil || !ok || row["name"] != "c" {
+		t.Fatalf("after recovery getRow(3) = %v, %v, %v", row, ok, err)
+	}
+
+	// once an import's flushes finish, nothing is left to replay
+	tb.importDataFromFile(in, 10, dir)
+	if err := tb.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tb = reopen(t, dir)
+	defer tb.wal.Close()
+	if tb.tr.Len() != 0 {
+		t.Fatalf("%d flushed rows replayed", tb.tr.Len())
+	}
+	if row, ok, err := tb.getRow(1); err != nil || !ok || row["name"] != "a" {
+		t.Fatalf("after flushing getRow(1) = %v, %v, %v", row, ok, err)
+	}
+}
+
+// writeLog writes a log at path holding pk 1 = name.
+func writeLog(t *testing.T, path, name string) {
+	t.Helper()
+	w, err := btreeWriting.CreateWALOf[int64](path, walOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(btree.Item{PK: 1, Row: btree.Row{"name": name}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWALRecoveryCrashPoints stops recovery of a flushing log at each step, as
+// a crash would, and checks that the next start still sees the newest row.
+func TestWALRecoveryCrashPoints(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() {
+		segmentFields = nil
+		filePaths = nil
+	})
+	active, flushing := filepath.Join(dir, walName), filepath.Join(dir, walFlushingName)
+	writeLog(t, flushing, "v1")
+	writeLog(t, active, "v2")
+	activeLog, err := os.ReadFile(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushingLog, err := os.ReadFile(flushing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a full recovery writes v2 to a segment and leaves neither log behind it
+	tb := reopen(t, dir)
+	if row, ok, err := tb.getRow(1); err != nil || !ok || row["name"] != "v2" {
+		t.Fatalf("after recovery getRow(1) = %v, %v, %v", row, ok, err)
+	}
+	if err := tb.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		name         string
+		keepFlushing bool
+	}{
+		{"segment written", true},
+		{"flushing log removed", false},
+	} {
+		if err := os.WriteFile(active, activeLog, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if step.keepFlushing {
+			if err := os.WriteFile(flushing, flushingLog, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tb := reopen(t, dir)
+		if row, ok, err := tb.getRow(1); err != nil || !ok || row["name"] != "v2" {
+			t.Fatalf("crash after %s: getRow(1) = %v, %v, %v", step.name, row, ok, err)
+		}
+		if err := tb.wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWALCorruptionStopsStartup(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() { filePaths = nil })
+	tb := newTable(ToInt64, formatAnyKey[int64])
+	tb.createBtree(dir)
+	if err := tb.openWAL(dir); err != nil {
+		t.Fatal(err)
+	}
+	for pk := int64(0); pk < 50; pk++ {
+		if err := tb.wal.Append(btree.Item{PK: pk, Row: btree.Row{"s": "hello world"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tb.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, walName)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0x40
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var ce *btreeWriting.CorruptionError
+	tb = newTable(ToInt64, formatAnyKey[int64])
+	if err := tb.openWAL(dir); !errors.As(err, &ce) {
+		t.Fatalf("openWAL = %v, want *CorruptionError", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(b)) {
+		t.Fatal("the damaged log was cut")
+	}
+}
+
+func TestFlushTree(t *testing.T) {
+	dir := t.TempDir()
+	var seq uint64
+	nextSeq := func() uint64 {
+		seq++
+		return seq
+	}
+
+	tr := btree.New(3)
+	for pk := int64(1); pk <= 7; pk++ {
+		tr.Upsert(btree.Item{PK: pk, Row: btree.Row{"v": pk}})
+	}
+	paths, err := flushTree(tr, dir, nextSeq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{segmentStore.SegmentName[int64](1, 4, 1), segmentStore.SegmentName[int64](5, 7, 2)}
+	if len(paths) != 2 || filepath.Base(paths[0]) != want[0] || filepath.Base(paths[1]) != want[1] {
+		t.Fatalf("flushTree wrote %v, want %v", paths, want)
+	}
+
+	// flushing the same rows again makes new files, and never replaces old ones
+	again, err := flushTree(tr, dir, nextSeq)
+	if err != nil || len(again) != 2 || slices.Contains(paths, again[0]) || slices.Contains(paths, again[1]) {
+		t.Fatalf("second flush wrote %v, %v", again, err)
+	}
+	seq = 0
+	if _, err := flushTree(tr, dir, nextSeq); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("flush onto existing names = %v, want fs.ErrExist", err)
+	}
+	if _, err := flushTree(tr, filepath.Join(dir, "missing"), nextSeq); err == nil {
+		t.Fatal("flush into a missing directory succeeded")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Fatalf("a failed flush left %s behind", e.Name())
+		}
+	}
+}
+
+func TestFlushErrors(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() { filePaths = nil })
+	// a crash mid-flush leaves a temp file, which startup clears away
+	junk := filepath.Join(dir, segmentStore.TempName(3, "flush"))
+	if err := os.WriteFile(junk, []byte("junk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tb := reopen(t, dir)
+	defer tb.wal.Close()
+	if _, err := os.Stat(junk); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("temp file kept at startup: %v", err)
+	}
+
+	// a background flush's error surfaces on the next wait, and its rows'
+	// log is kept for the next start
+	tb.tr.Upsert(btree.Item{PK: 100, Row: btree.Row{"v": "x"}})
+	if err := tb.wal.Append(btree.Item{PK: 100, Row: btree.Row{"v": "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.writeMapToFile(filepath.Join(dir, "missing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.waitForFlush(); err == nil {
+		t.Fatal("the flush error was swallowed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, walFlushingName)); err != nil {
+		t.Fatalf("the failed flush's log was removed: %v", err)
+	}
+}
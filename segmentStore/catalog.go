@@ -0,0 +1,389 @@
+// Package segmentStore answers reads against the .spdb files that
+// writeMapToFile leaves behind. Files are named <minPK>_<maxPK>_<seq>.spdb, so
+// the catalog only needs the directory listing to know which files can hold a
+// key and which of them is newest. String keys are hex-encoded with an "s"
+// prefix (see FormatKey); when that makes a name too long, the file is named
+// <seq>.spdb and the catalog reads its range from the footer instead.
+package segmentStore
+
+import (
+	"SpeedyDb/btree"
+	"SpeedyDb/btreeWriting"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Many segments can be open at once during a scan, so readers use a much
+// smaller buffer than the 16 MiB default.
+const segmentReadBufferSize = 256 << 10
+
+// SegmentFileOf is one .spdb file and the inclusive PK range and sequence
+// number encoded in its name.
+type SegmentFileOf[K btreeWriting.Key] struct {
+	Path  string
+	MinPK K
+	MaxPK K
+
+	// Seq orders segments by age: a file written later has a higher one.
+	// Files named before sequence numbers existed have 0 and are ordered
+	// among themselves by ModTime.
+	Seq     uint64
+	ModTime time.Time
+}
+
+// newer reports whether a's rows shadow b's.
+func newer[K btreeWriting.Key](a, b SegmentFileOf[K]) bool {
+	if a.Seq != b.Seq {
+		return a.Seq > b.Seq
+	}
+	return a.ModTime.After(b.ModTime)
+}
+
+// sortNewestFirst orders segs so each one shadows those after it.
+func sortNewestFirst[K btreeWriting.Key](segs []SegmentFileOf[K]) {
+	sort.SliceStable(segs, func(i, j int) bool { return newer(segs[i], segs[j]) })
+}
+
+// CatalogOf is the set of known segment files ordered by MinPK.
+type CatalogOf[K btreeWriting.Key] struct {
+	segments []SegmentFileOf[K]
+
+	// lastSeq is the highest sequence number handed out or seen in a name.
+	// It is atomic so a background flush can take numbers while the owner
+	// of the catalog reads it.
+	lastSeq atomic.Uint64
+}
+
+// SegmentFile, Catalog and ScanIter are the int64-keyed forms.
+type (
+	SegmentFile = SegmentFileOf[int64]
+	Catalog     = CatalogOf[int64]
+	ScanIter    = ScanIterOf[int64]
+)
+
+// FormatKey renders a key for use in a segment file name: decimal for int64
+// keys, "s" + hex for string keys so any bytes are safe in a path.
+func FormatKey[K btreeWriting.Key](k K) string {
+	switch k := any(k).(type) {
+	case int64:
+		return strconv.FormatInt(k, 10)
+	case string:
+		return "s" + hex.EncodeToString([]byte(k))
+	}
+	panic("unreachable")
+}
+
+// maxNameLen is the longest segment name that spells out its key range. Most
+// file systems stop at 255 bytes, and hex doubles the length of a string key.
+const maxNameLen = 200
+
+// SegmentName is the file name for a segment holding minPK..maxPK, written
+// with sequence number seq (see CatalogOf.NextSeq). If the keys make that
+// longer than maxNameLen, the name is just "<seq>.spdb".
+func SegmentName[K btreeWriting.Key](minPK, maxPK K, seq uint64) string {
+	name := FormatKey(minPK) + "_" + FormatKey(maxPK) + "_" + strconv.FormatUint(seq, 10) + ".spdb"
+	if len(name) > maxNameLen {
+		return strconv.FormatUint(seq, 10) + ".spdb"
+	}
+	return name
+}
+
+// tempSuffix marks a segment still being written. Such names do not end in
+// .spdb, so nothing mistakes a half-written file for a segment.
+const tempSuffix = ".spdb.tmp"
+
+// TempName is the file name to write the segment that will get sequence
+// number seq under, before CommitFile gives it its final name. what says
+// which writer it belongs to, e.g. "flush" or "compacting".
+func TempName(seq uint64, what string) string {
+	return strconv.FormatUint(seq, 10) + "_" + what + tempSuffix
+}
+
+// CommitFile gives a written and synced temp file its final path and syncs
+// the directory, so after a crash the file is either absent or whole under its
+// final name. It never replaces a file already at finalPath: that fails with
+// an error matching fs.ErrExist and leaves tmpPath in place.
+//
+// A rename replaces its target, so the check comes first. That is only safe
+// because nothing else creates final names in the directory at the same time:
+// each writer commits under a sequence number no other one is given.
+func CommitFile(tmpPath, finalPath string) error {
+	if _, err := os.Lstat(finalPath); err == nil {
+		return &os.LinkError{Op: "rename", Old: tmpPath, New: finalPath, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(finalPath))
+}
+
+// SyncDir fsyncs a directory, making renames and removals in it durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// RemoveTempFiles deletes the temp files a crash left in dir.
+func RemoveTempFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), tempSuffix) {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseKey[K btreeWriting.Key](s string) (K, bool) {
+	var k K
+	switch p := any(&k).(type) {
+	case *int64:
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return k, false
+		}
+		*p = v
+	case *string:
+		h, found := strings.CutPrefix(s, "s")
+		if !found {
+			return k, false
+		}
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			return k, false
+		}
+		*p = string(b)
+	}
+	return k, true
+}
+
+// ParseSegmentName extracts the PK range and sequence number from a
+// "<minPK>_<maxPK>_<seq>.spdb" file name. Older "<minPK>_<maxPK>.spdb" names
+// parse with seq 0. ok=false for anything else (e.g. the TempName files still
+// being written).
+func ParseSegmentName(name string) (minPK, maxPK int64, seq uint64, ok bool) {
+	return ParseSegmentNameOf[int64](name)
+}
+
+// ParseSegmentNameOf is ParseSegmentName for any key type. Names written for
+// the other key type do not parse, and nor do "<seq>.spdb" names, which have
+// no range in them (see CatalogOf.Add).
+func ParseSegmentNameOf[K btreeWriting.Key](name string) (minPK, maxPK K, seq uint64, ok bool) {
+	base, found := strings.CutSuffix(filepath.Base(name), ".spdb")
+	if !found {
+		return minPK, maxPK, 0, false
+	}
+	parts := strings.Split(base, "_")
+	switch len(parts) {
+	case 2:
+	case 3:
+		var err error
+		seq, err = strconv.ParseUint(parts[2], 10, 64)
+		if err != nil || seq == 0 {
+			return minPK, maxPK, 0, false
+		}
+	default:
+		return minPK, maxPK, 0, false
+	}
+	minPK, ok = parseKey[K](parts[0])
+	if !ok {
+		return minPK, maxPK, 0, false
+	}
+	maxPK, ok = parseKey[K](parts[1])
+	if !ok || maxPK < minPK {
+		return minPK, maxPK, 0, false
+	}
+	return minPK, maxPK, seq, true
+}
+
+// parseSeqName extracts the sequence number from a "<seq>.spdb" file name.
+func parseSeqName(name string) (seq uint64, ok bool) {
+	base, found := strings.CutSuffix(filepath.Base(name), ".spdb")
+	if !found {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(base, 10, 64)
+	return seq, err == nil && seq != 0
+}
+
+// isLegacyName reports whether name is a "<minPK>_<maxPK>.spdb" name from
+// before sequence numbers. Builds of that era could name a file for the wrong
+// range (a tree that fit in one file became "<minPK>_0.spdb"), so the catalog
+// reads the range of such files from the file itself.
+func isLegacyName[K btreeWriting.Key](name string) bool {
+	base, found := strings.CutSuffix(filepath.Base(name), ".spdb")
+	if !found {
+		return false
+	}
+	lo, hi, found := strings.Cut(base, "_")
+	if !found {
+		return false
+	}
+	_, okLo := parseKey[K](lo)
+	_, okHi := parseKey[K](hi)
+	return okLo && okHi
+}
+
+var errNotSegmentName = errors.New("not a segment file name")
+
+// NewCatalog builds a catalog from segment paths. Paths whose names are not
+// segment names are skipped.
+func NewCatalog(paths []string) (*Catalog, error) {
+	return NewCatalogOf[int64](paths)
+}
+
+// NewCatalogOf is NewCatalog for any key type; files with the other key type
+// are skipped.
+func NewCatalogOf[K btreeWriting.Key](paths []string) (*CatalogOf[K], error) {
+	c := &CatalogOf[K]{}
+	for _, p := range paths {
+		err := c.Add(p)
+		if errors.Is(err, errNotSegmentName) || errors.Is(err, btreeWriting.ErrKeyType) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Add registers a finished segment file. The range of a "<seq>.spdb" file is
+// read from its footer. A path can only be added once.
+func (c *CatalogOf[K]) Add(path string) error {
+	if slices.ContainsFunc(c.segments, func(seg SegmentFileOf[K]) bool { return seg.Path == path }) {
+		return fmt.Errorf("%s is already in the catalog", path)
+	}
+	minPK, maxPK, seq, ok := ParseSegmentNameOf[K](path)
+	if !ok || seq == 0 {
+		if !ok && !isLegacyName[K](path) {
+			if seq, ok = parseSeqName(path); !ok {
+				return fmt.Errorf("%w: %q", errNotSegmentName, path)
+			}
+		}
+		var err error
+		if minPK, maxPK, err = footerRange[K](path); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	c.noteSeq(seq)
+
+	seg := SegmentFileOf[K]{Path: path, MinPK: minPK, MaxPK: maxPK, Seq: seq, ModTime: info.ModTime()}
+	i := sort.Search(len(c.segments), func(i int) bool { return c.segments[i].MinPK > minPK })
+	c.segments = append(c.segments, SegmentFileOf[K]{})
+	copy(c.segments[i+1:], c.segments[i:])
+	c.segments[i] = seg
+	return nil
+}
+
+func (c *CatalogOf[K]) Len() int {
+	return len(c.segments)
+}
+
+// NextSeq returns a sequence number above every one in the catalog or handed
+// out before, for naming a new segment. It is safe to call from any goroutine.
+func (c *CatalogOf[K]) NextSeq() uint64 {
+	return c.lastSeq.Add(1)
+}
+
+// noteSeq raises lastSeq to seq.
+func (c *CatalogOf[K]) noteSeq(seq uint64) {
+	for {
+		last := c.lastSeq.Load()
+		if seq <= last || c.lastSeq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+// Covering returns the segments whose range contains pk, newest first, so the
+// first hit is the value that shadows the rest.
+func (c *CatalogOf[K]) Covering(pk K) []SegmentFileOf[K] {
+	var out []SegmentFileOf[K]
+	// segments are sorted by MinPK, so everything past the first MinPK > pk is out of range
+	end := sort.Search(len(c.segments), func(i int) bool { return c.segments[i].MinPK > pk })
+	for _, seg := range c.segments[:end] {
+		if pk <= seg.MaxPK {
+			out = append(out, seg)
+		}
+	}
+	sortNewestFirst(out)
+	return out
+}
+
+// Get returns the row stored for pk in the newest segment that has it.
+// ok=false if that newest record is a tombstone.
+func (c *CatalogOf[K]) Get(pk K) (btree.Row, bool, error) {
+	for _, seg := range c.Covering(pk) {
+		it, ok, err := getFromSegment(seg.Path, pk)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			if it.Deleted {
+				return nil, false, nil
+			}
+			return it.Row, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Remove forgets the segment at path. It does not delete the file.
+func (c *CatalogOf[K]) Remove(path string) bool {
+	for i, seg := range c.segments {
+		if seg.Path == path {
+			c.segments = append(c.segments[:i], c.segments[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// footerRange returns the key range recorded in a segment's footer.
+func footerRange[K btreeWriting.Key](path string) (minPK, maxPK K, err error) {
+	seg, err := btreeWriting.OpenSegmentOf[K](path)
+	if err != nil {
+		return minPK, maxPK, err
+	}
+	defer seg.Close()
+	ft := seg.Footer()
+	return ft.MinPK, ft.MaxPK, nil
+}
+
+func getFromSegment[K btreeWriting.Key](path string, pk K) (btree.ItemOf[K], bool, error) {
+	seg, err := btreeWriting.OpenSegmentOf[K](path)
+	if err != nil {
+		return btree.ItemOf[K]{}, false, err
+	}
+	defer seg.Close()
+	return seg.Get(pk)
+}
@@ -0,0 +1,325 @@
+package segmentStore
+
+import (
+	"SpeedyDb/btree"
+	"SpeedyDb/btreeWriting"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSegment writes items to dir under name and returns the path.
+func writeSegment[K btreeWriting.Key](t *testing.T, dir, name string, items []btree.ItemOf[K]) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := btreeWriting.NewWriterOf[K](f, btreeWriting.WriterOptions{IndexBlockSize: 256})
+	for _, it := range items {
+		if err := w.WriteItem(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// evens returns items for the even keys in lo..hi, each row tagged v.
+func evens(lo, hi int64, v string) []btree.Item {
+	var items []btree.Item
+	for pk := lo; pk <= hi; pk += 2 {
+		items = append(items, btree.Item{PK: pk, Row: btree.Row{"v": v}})
+	}
+	return items
+}
+
+func TestParseSegmentName(t *testing.T) {
+	tests := []struct {
+		name   string
+		lo, hi int64
+		seq    uint64
+		ok     bool
+	}{
+		{"0_100_1.spdb", 0, 100, 1, true},
+		{"/data/-50_-3_12.spdb", -50, -3, 12, true},
+		{"7_7_3.spdb", 7, 7, 3, true},
+		{"-9223372036854775808_9223372036854775807_4.spdb", math.MinInt64, math.MaxInt64, 4, true},
+		{"0_100.spdb", 0, 100, 0, true}, // from before sequence numbers
+		{"0_100_0.spdb", 0, 0, 0, false},
+		{"0_100_x.spdb", 0, 0, 0, false},
+		{"0_100_1_2.spdb", 0, 0, 0, false},
+		{"9_3_1.spdb", 0, 0, 0, false},
+		{"0_9223372036854775808_1.spdb", 0, 0, 0, false},
+		{"0_100_1.spdb.tmp", 0, 0, 0, false},
+		{"0_flush.spdb.tmp", 0, 0, 0, false},
+		{"a_b_1.spdb", 0, 0, 0, false},
+		{"100.spdb", 0, 0, 0, false},
+		{"SpeedyDb.wal", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		lo, hi, seq, ok := ParseSegmentName(tt.name)
+		if ok != tt.ok || (ok && (lo != tt.lo || hi != tt.hi || seq != tt.seq)) {
+			t.Errorf("ParseSegmentName(%q) = %d, %d, %d, %v, want %d, %d, %d, %v", tt.name, lo, hi, seq, ok, tt.lo, tt.hi, tt.seq, tt.ok)
+		}
+		if tt.ok && tt.seq != 0 {
+			if name := SegmentName(tt.lo, tt.hi, tt.seq); name != filepath.Base(tt.name) {
+				t.Errorf("SegmentName(%d, %d, %d) = %q, want %q", tt.lo, tt.hi, tt.seq, name, filepath.Base(tt.name))
+			}
+		}
+	}
+}
+
+func TestCatalogGet(t *testing.T) {
+	dir := t.TempDir()
+	a := writeSegment(t, dir, SegmentName[int64](0, 100, 1), evens(0, 100, "a"))
+	b := writeSegment(t, dir, SegmentName[int64](-50, -2, 2), evens(-50, -2, "b"))
+	c, err := NewCatalog([]string{a, b, filepath.Join(dir, "notes.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", c.Len())
+	}
+
+	for _, pk := range []int64{-60, -51, -50, -3, -2, -1, 0, 1, 50, 51, 100, 101, 200} {
+		row, ok, err := c.Get(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		switch {
+		case pk%2 != 0:
+		case pk >= -50 && pk <= -2:
+			want = "b"
+		case pk >= 0 && pk <= 100:
+			want = "a"
+		}
+		if ok != (want != "") || (ok && row["v"] != want) {
+			t.Errorf("Get(%d) = %v, %v, want %q", pk, row, ok, want)
+		}
+	}
+
+	if !c.Remove(a) || c.Remove(a) {
+		t.Fatal("Remove should succeed once")
+	}
+	if _, ok, _ := c.Get(50); ok {
+		t.Fatal("Get found a row in a removed segment")
+	}
+}
+
+// TestCatalogNewestWins checks that the sequence number in the name decides
+// which copy of a key is current, whatever the file times say.
+func TestCatalogNewestWins(t *testing.T) {
+	dir := t.TempDir()
+	old := writeSegment(t, dir, SegmentName[int64](0, 100, 1), evens(0, 100, "old"))
+	mid := writeSegment(t, dir, SegmentName[int64](40, 60, 2), evens(40, 60, "mid"))
+	newest := writeSegment(t, dir, SegmentName[int64](50, 52, 3), []btree.Item{
+		{PK: 50, Row: btree.Row{"v": "new"}},
+		{PK: 52, Deleted: true},
+	})
+
+	// give the oldest file the newest time, as a copy or restore might
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(old, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCatalog([]string{newest, old, mid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pk, want := range map[int64]string{0: "old", 40: "mid", 48: "mid", 50: "new", 52: "", 54: "mid", 62: "old"} {
+		row, ok, err := c.Get(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (want != "") || (ok && row["v"] != want) {
+			t.Errorf("Get(%d) = %v, %v, want %q", pk, row, ok, want)
+		}
+	}
+
+	if seq := c.NextSeq(); seq != 4 {
+		t.Fatalf("NextSeq = %d, want 4", seq)
+	}
+}
+
+// writeV0Segment writes items to dir under name the way builds before the
+// file header did: bare [u32 len][u32 pk][u16 n] records with inline field
+// names and nothing after them. Every row must be {"v": string}.
+func writeV0Segment(t *testing.T, dir, name string, items []btree.Item) string {
+	t.Helper()
+	var b []byte
+	for _, it := range items {
+		v := it.Row["v"].(string)
+		rec := binary.LittleEndian.AppendUint32(nil, uint32(it.PK))
+		rec = binary.LittleEndian.AppendUint16(rec, 1)
+		rec = append(rec, 1, 'v', 4) // tag 4: string
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(len(v)))
+		rec = append(rec, v...)
+		b = append(binary.LittleEndian.AppendUint32(b, uint32(len(rec))), rec...)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestCatalogLegacyNames checks that files named without a sequence number,
+// which were written without a header, are read, are older than any that have
+// one, and are ordered among themselves by ModTime. Their names are not
+// trusted for the key range.
+func TestCatalogLegacyNames(t *testing.T) {
+	dir := t.TempDir()
+	a := writeV0Segment(t, dir, "0_10.spdb", evens(0, 10, "a"))
+	// the old writer named a tree that fit in one file <minPK>_0.spdb
+	b := writeV0Segment(t, dir, "4_0.spdb", evens(4, 6, "b"))
+	c := writeSegment(t, dir, SegmentName[int64](6, 8, 1), evens(6, 8, "c"))
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(a, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	cat, err := NewCatalog([]string{a, b, c})
+	if err != nil || cat.Len() != 3 {
+		t.Fatalf("NewCatalog: %d segments, %v", cat.Len(), err)
+	}
+	for pk, want := range map[int64]string{2: "a", 4: "b", 6: "c", 8: "c", 10: "a"} {
+		if row, ok, err := cat.Get(pk); err != nil || !ok || row["v"] != want {
+			t.Errorf("Get(%d) = %v, %v, %v, want %q", pk, row, ok, err, want)
+		}
+	}
+	got := scanAll(t, cat, nil, 0, 11)
+	want := []string{"0=a", "2=a", "4=b", "6=c", "8=c", "10=a"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Scan = %v, want %v", got, want)
+	}
+}
+
+func TestCatalogStringKeys(t *testing.T) {
+	dir := t.TempDir()
+	var items []btree.ItemOf[string]
+	for _, k := range []string{"apple", "banana", "cherry", "kiwi", "zebra"} {
+		items = append(items, btree.ItemOf[string]{PK: k, Row: btree.Row{"v": k}})
+	}
+	p := writeSegment(t, dir, SegmentName("apple", "zebra", 1), items)
+	if lo, hi, _, ok := ParseSegmentNameOf[string](p); !ok || lo != "apple" || hi != "zebra" {
+		t.Fatalf("ParseSegmentNameOf(%q) = %q, %q, %v", p, lo, hi, ok)
+	}
+
+	c, err := NewCatalogOf[string]([]string{p})
+	if err != nil || c.Len() != 1 {
+		t.Fatalf("NewCatalogOf: %d segments, %v", c.Len(), err)
+	}
+	if row, ok, err := c.Get("kiwi"); !ok || err != nil || row["v"] != "kiwi" {
+		t.Fatalf("Get(kiwi) = %v, %v, %v", row, ok, err)
+	}
+	if _, ok, _ := c.Get("kiwis"); ok {
+		t.Fatal("Get(kiwis) found a row")
+	}
+
+	mem := btree.NewOf[string](2)
+	mem.Upsert(btree.ItemOf[string]{PK: "date", Row: btree.Row{"v": "mem"}})
+	mem.Upsert(btree.ItemOf[string]{PK: "cherry", Deleted: true})
+	it := c.Scan(mem, "b", "l")
+	defer it.Close()
+	var got []string
+	for {
+		x, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, x.PK)
+	}
+	if it.Err() != nil || !slices.Equal(got, []string{"banana", "date", "kiwi"}) {
+		t.Fatalf("Scan = %q, %v", got, it.Err())
+	}
+
+	// an int64 catalog passes over string-keyed files
+	if ic, err := NewCatalog([]string{p}); err != nil || ic.Len() != 0 {
+		t.Fatalf("NewCatalog: %d segments, %v", ic.Len(), err)
+	}
+}
+
+// TestCatalogLongKeys checks that keys too long to spell out in a file name
+// still give a usable segment, whose range comes from its footer.
+func TestCatalogLongKeys(t *testing.T) {
+	dir := t.TempDir()
+	lo, hi := strings.Repeat("a", 1000), strings.Repeat("z", 60000)
+	name := SegmentName(lo, hi, 7)
+	if name != "7.spdb" {
+		t.Fatalf("SegmentName with long keys = %.40q...", name)
+	}
+	if name := SegmentName("a", "b", 7); len(name) > maxNameLen || name == "7.spdb" {
+		t.Fatalf("SegmentName with short keys = %q", name)
+	}
+
+	p := writeSegment(t, dir, name, []btree.ItemOf[string]{
+		{PK: lo, Row: btree.Row{"v": "lo"}},
+		{PK: "m", Row: btree.Row{"v": "m"}},
+		{PK: hi, Row: btree.Row{"v": "hi"}},
+	})
+	c, err := NewCatalogOf[string]([]string{p})
+	if err != nil || c.Len() != 1 {
+		t.Fatalf("NewCatalogOf: %d segments, %v", c.Len(), err)
+	}
+	seg := c.Segments()[0]
+	if seg.MinPK != lo || seg.MaxPK != hi || seg.Seq != 7 {
+		t.Fatalf("segment range %.10q..%.10q seq %d", seg.MinPK, seg.MaxPK, seg.Seq)
+	}
+	for k, want := range map[string]string{lo: "lo", "m": "m", hi: "hi"} {
+		if row, ok, err := c.Get(k); !ok || err != nil || row["v"] != want {
+			t.Fatalf("Get(%.10q) = %v, %v, %v", k, row, ok, err)
+		}
+	}
+	if c.NextSeq() != 8 {
+		t.Fatal("NextSeq ignored the sequence number of a range-less name")
+	}
+
+	if ic, err := NewCatalog([]string{p}); err != nil || ic.Len() != 0 {
+		t.Fatalf("NewCatalog: %d segments, %v", ic.Len(), err)
+	}
+}
+
+func TestCommitFile(t *testing.T) {
+	dir := t.TempDir()
+	tmp := writeSegment(t, dir, TempName(2, "flush"), evens(0, 10, "new"))
+	final := filepath.Join(dir, SegmentName[int64](0, 10, 2))
+	if err := CommitFile(tmp, final); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("temp file still there after commit: %v", err)
+	}
+
+	// a second file for the same name is refused, not swapped in
+	tmp = writeSegment(t, dir, TempName(3, "flush"), evens(0, 10, "other"))
+	if err := CommitFile(tmp, final); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("CommitFile over an existing segment = %v, want fs.ErrExist", err)
+	}
+	c, err := NewCatalog([]string{final})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row, ok, err := c.Get(4); err != nil || !ok || row["v"] != "new" {
+		t.Fatalf("Get(4) = %v, %v, %v, want the first file's row", row, ok, err)
+	}
+
+	if err := c.Add(final); err == nil || c.Len() != 1 {
+		t.Fatalf("adding a path twice: err %v, %d segments", err, c.Len())
+	}
+	if _, err := NewCatalog([]string{final, final}); err == nil {
+		t.Fatal("NewCatalog took the same path twice")
+	}
+}
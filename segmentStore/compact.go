@@ -0,0 +1,163 @@
+package segmentStore
+
+import (
+	"SpeedyDb/btreeWriting"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Segments returns the catalogued segments ordered by MinPK.
+func (c *CatalogOf[K]) Segments() []SegmentFileOf[K] {
+	return slices.Clone(c.segments)
+}
+
+// Compact merges the segments at paths into one new file in dir and swaps it
+// into the catalog in their place. Newer copies of a key win as in Scan.
+//
+// A tombstone is carried into the new file while some older segment outside
+// the compaction could still hold its key, and dropped otherwise. The new file
+// takes the next sequence number, making it the newest on disk, so every
+// other segment overlapping the inputs must be older than all of them, or
+// compacting would let old rows shadow newer ones.
+//
+// ok=false means every record cancelled out and no file was written. The
+// inputs are removed from the catalog and deleted only after the new file is
+// in place, oldest first with the directory synced after each, so a crash part
+// way leaves some inputs behind but never a newer input's tombstone without
+// the older row it hides.
+func (c *CatalogOf[K]) Compact(paths []string, dir string, opts btreeWriting.WriterOptions) (out SegmentFileOf[K], ok bool, err error) {
+	var inputs []SegmentFileOf[K]
+	isInput := func(path string) bool {
+		return slices.ContainsFunc(inputs, func(in SegmentFileOf[K]) bool { return in.Path == path })
+	}
+	for _, p := range paths {
+		i := slices.IndexFunc(c.segments, func(seg SegmentFileOf[K]) bool { return seg.Path == p })
+		if i < 0 {
+			return out, false, fmt.Errorf("compact: %s is not in the catalog", p)
+		}
+		if !isInput(p) {
+			inputs = append(inputs, c.segments[i])
+		}
+	}
+	if len(inputs) == 0 {
+		return out, false, errors.New("compact: no segments given")
+	}
+
+	lo, hi := inputs[0].MinPK, inputs[0].MaxPK
+	oldest := inputs[0]
+	for _, seg := range inputs[1:] {
+		lo, hi = min(lo, seg.MinPK), max(hi, seg.MaxPK)
+		if newer(oldest, seg) {
+			oldest = seg
+		}
+	}
+
+	// Segments left out of the compaction that may share keys with it.
+	var older []SegmentFileOf[K]
+	for _, seg := range c.segments {
+		if seg.MinPK > hi || seg.MaxPK < lo || isInput(seg.Path) {
+			continue
+		}
+		if !newer(oldest, seg) {
+			return out, false, fmt.Errorf("compact: %s overlaps the inputs and is not older than all of them", seg.Path)
+		}
+		older = append(older, seg)
+	}
+
+	sortNewestFirst(inputs)
+	it := &ScanIterOf[K]{tombstones: true}
+	for _, seg := range inputs {
+		it.sources = append(it.sources, &fileSource[K]{path: seg.Path, lo: seg.MinPK, hi: seg.MaxPK, hiInclusive: true})
+	}
+	it.start()
+	defer it.Close()
+
+	seq := c.NextSeq()
+	tmpPath := filepath.Join(dir, TempName(seq, "compacting"))
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return out, false, err
+	}
+	w := btreeWriting.NewWriterOf[K](f, opts)
+
+	var minPK, maxPK K
+	for {
+		item, more := it.Next()
+		if !more {
+			break
+		}
+		if item.Deleted && !coveredBy(older, item.PK) {
+			continue
+		}
+		if err := w.WriteItem(item); err != nil {
+			_ = w.Close()
+			_ = os.Remove(tmpPath)
+			return out, false, err
+		}
+		if w.Records == 1 {
+			minPK = item.PK
+		}
+		maxPK = item.PK
+	}
+	if err := it.Err(); err != nil {
+		_ = w.Close()
+		_ = os.Remove(tmpPath)
+		return out, false, err
+	}
+	if err := w.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return out, false, err
+	}
+
+	var finalPath string
+	if w.Records > 0 {
+		// a new sequence number, so never the name of an input
+		finalPath = filepath.Join(dir, SegmentName(minPK, maxPK, seq))
+		if err := CommitFile(tmpPath, finalPath); err != nil {
+			_ = os.Remove(tmpPath)
+			return out, false, err
+		}
+	} else if err := os.Remove(tmpPath); err != nil {
+		return out, false, err
+	}
+
+	// the inputs must be closed before they are deleted
+	if err := it.Close(); err != nil {
+		return out, false, err
+	}
+	// inputs is newest first; deleting a tombstone before the rows it hides
+	// would let a crash bring them back
+	for _, seg := range slices.Backward(inputs) {
+		c.Remove(seg.Path)
+		if err := removeFile(seg.Path); err != nil {
+			return out, false, err
+		}
+		if err := SyncDir(filepath.Dir(seg.Path)); err != nil {
+			return out, false, err
+		}
+	}
+	if finalPath == "" {
+		return out, false, nil
+	}
+	if err := c.Add(finalPath); err != nil {
+		return out, false, err
+	}
+	i := slices.IndexFunc(c.segments, func(seg SegmentFileOf[K]) bool { return seg.Path == finalPath })
+	return c.segments[i], true, nil
+}
+
+// removeFile deletes a compacted input. Tests replace it to stop part way.
+var removeFile = os.Remove
+
+// coveredBy reports whether any of segs has pk inside its range.
+func coveredBy[K btreeWriting.Key](segs []SegmentFileOf[K], pk K) bool {
+	for _, seg := range segs {
+		if seg.MinPK <= pk && pk <= seg.MaxPK {
+			return true
+		}
+	}
+	return false
+}
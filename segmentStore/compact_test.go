@@ -0,0 +1,179 @@
+package segmentStore
+
+import (
+	"SpeedyDb/btree"
+	"SpeedyDb/btreeWriting"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// checkVisible verifies what c and a scan over c show for the segments built
+// in TestCompactTombstones.
+func checkVisible(t *testing.T, c *Catalog) {
+	t.Helper()
+	for _, pk := range []int64{5, 7, 8, 150} {
+		if row, ok, err := c.Get(pk); ok || err != nil {
+			t.Fatalf("Get(%d) = %v, %v, %v, want deleted", pk, row, ok, err)
+		}
+	}
+	if row, ok, err := c.Get(6); !ok || err != nil || row["v"] != "old" {
+		t.Fatalf("Get(6) = %v, %v, %v", row, ok, err)
+	}
+
+	mem := btree.New(2)
+	mem.Upsert(btree.Item{PK: 9, Deleted: true})
+	mem.Upsert(btree.Item{PK: 8, Row: btree.Row{"v": "mem"}})
+	got := scanAll(t, c, mem, 0, 200)
+	if len(got) != 97 || !slices.Contains(got, "8=mem") {
+		t.Fatalf("scan returned %d rows, want 97 with 8=mem", len(got))
+	}
+	for _, s := range got {
+		switch s {
+		case "5=old", "7=old", "7=new", "9=old", "8=old":
+			t.Fatalf("scan returned %s", s)
+		}
+	}
+}
+
+func TestCompactTombstones(t *testing.T) {
+	dir := t.TempDir()
+	var rows []btree.Item
+	for pk := int64(0); pk < 100; pk++ {
+		rows = append(rows, btree.Item{PK: pk, Row: btree.Row{"v": "old"}})
+	}
+	p0 := writeSegment(t, dir, SegmentName[int64](0, 99, 1), rows)
+	p1 := writeSegment(t, dir, SegmentName[int64](5, 150, 2), []btree.Item{
+		{PK: 5, Deleted: true},
+		{PK: 7, Row: btree.Row{"v": "new"}},
+		{PK: 150, Deleted: true},
+	})
+	p2 := writeSegment(t, dir, SegmentName[int64](7, 8, 3), []btree.Item{
+		{PK: 7, Deleted: true},
+		{PK: 8, Deleted: true},
+	})
+	c, err := NewCatalog([]string{p0, p1, p2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVisible(t, c)
+
+	// p0 still holds 5, 7 and 8, so their tombstones must survive; nothing
+	// older holds 150, so its tombstone can go
+	out, ok, err := c.Compact([]string{p1, p2}, dir, btreeWriting.WriterOptions{})
+	if err != nil || !ok {
+		t.Fatalf("Compact = %v, %v", ok, err)
+	}
+	s, err := btreeWriting.OpenSegment(out.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft := s.Footer(); ft.Records != 3 || ft.Tombstones != 3 || ft.MaxPK != 8 {
+		t.Fatalf("compacted footer: %d records, %d tombstones, max %d", ft.Records, ft.Tombstones, ft.MaxPK)
+	}
+	s.Close()
+	if out.Seq <= 3 {
+		t.Fatalf("compacted segment has seq %d, want a new one", out.Seq)
+	}
+	for _, p := range []string{p1, p2} {
+		if _, err := os.Stat(p); err == nil {
+			t.Fatalf("input %s was not deleted", p)
+		}
+	}
+	checkVisible(t, c)
+
+	// p0 is older than the segment that now shadows parts of it
+	if _, _, err := c.Compact([]string{p0}, dir, btreeWriting.WriterOptions{}); err == nil {
+		t.Fatal("Compact merged a segment with a newer one left out")
+	}
+
+	var all []string
+	for _, seg := range c.Segments() {
+		all = append(all, seg.Path)
+	}
+	out, ok, err = c.Compact(all, dir, btreeWriting.WriterOptions{})
+	if err != nil || !ok {
+		t.Fatalf("Compact = %v, %v", ok, err)
+	}
+	s, err = btreeWriting.OpenSegment(out.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft := s.Footer(); ft.Records != 97 || ft.Tombstones != 0 {
+		t.Fatalf("fully compacted footer: %d records, %d tombstones", ft.Records, ft.Tombstones)
+	}
+	s.Close()
+	checkVisible(t, c)
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 || c.Len() != 1 {
+		t.Fatalf("%d files and %d segments left, want 1", len(entries), c.Len())
+	}
+}
+
+func TestCompactAllDeleted(t *testing.T) {
+	dir := t.TempDir()
+	p0 := writeSegment(t, dir, SegmentName[int64](1, 2, 1), evens(2, 2, "a"))
+	p1 := writeSegment(t, dir, SegmentName[int64](2, 2, 2), []btree.Item{{PK: 2, Deleted: true}})
+	c, err := NewCatalog([]string{p0, p1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.Compact([]string{p0, p1}, dir, btreeWriting.WriterOptions{}); err != nil || ok {
+		t.Fatalf("Compact = %v, %v, want nothing written", ok, err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 || c.Len() != 0 {
+		t.Fatalf("%d files and %d segments left, want none", len(entries), c.Len())
+	}
+}
+
+// TestCompactCrashWhileRemoving stops Compact after it has deleted one input,
+// as a crash would, and checks that what is left on disk still hides the
+// deleted key.
+func TestCompactCrashWhileRemoving(t *testing.T) {
+	dir := t.TempDir()
+	p0 := writeSegment(t, dir, SegmentName[int64](1, 4, 1), []btree.Item{
+		{PK: 1, Row: btree.Row{"v": "old"}},
+		{PK: 2, Row: btree.Row{"v": "old"}},
+		{PK: 3, Row: btree.Row{"v": "old"}},
+	})
+	p1 := writeSegment(t, dir, SegmentName[int64](2, 3, 2), []btree.Item{
+		{PK: 2, Deleted: true},
+		{PK: 3, Row: btree.Row{"v": "new"}},
+	})
+	c, err := NewCatalog([]string{p0, p1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crash := errors.New("crash")
+	removed := 0
+	removeFile = func(path string) error {
+		if removed == 1 {
+			return crash
+		}
+		removed++
+		return os.Remove(path)
+	}
+	defer func() { removeFile = os.Remove }()
+	// nothing older holds 2, so the new file drops its tombstone
+	if _, _, err := c.Compact([]string{p0, p1}, dir, btreeWriting.WriterOptions{}); !errors.Is(err, crash) {
+		t.Fatalf("Compact = %v, want the injected crash", err)
+	}
+
+	// start over from what is on disk
+	paths, err := filepath.Glob(filepath.Join(dir, "*.spdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewCatalog(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pk, want := range map[int64]string{1: "old", 2: "", 3: "new"} {
+		row, ok, err := c.Get(pk)
+		if err != nil || ok != (want != "") || (ok && row["v"] != want) {
+			t.Errorf("Get(%d) = %v, %v, %v, want %q", pk, row, ok, err, want)
+		}
+	}
+}
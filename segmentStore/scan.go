@@ -0,0 +1,235 @@
+package segmentStore
+
+import (
+	"SpeedyDb/btree"
+	"SpeedyDb/btreeWriting"
+	"container/heap"
+	"errors"
+	"io"
+)
+
+// source is one ascending stream of items feeding a scan. A source's rank is its
+// index in ScanIter.sources: lower rank = newer, and the newest copy of a PK wins.
+type source[K btreeWriting.Key] interface {
+	next() (btree.ItemOf[K], bool, error)
+	close() error
+}
+
+// ScanIterOf yields items with lo <= PK < hi in ascending PK order, merged from
+// the in-memory tree and every overlapping segment.
+type ScanIterOf[K btreeWriting.Key] struct {
+	h       mergeHeap[K]
+	sources []source[K]
+	err     error
+
+	// tombstones makes Next return winning tombstones instead of skipping
+	// them (compaction has to carry them forward).
+	tombstones bool
+}
+
+// Scan merges mem (may be nil) with all segments overlapping [lo, hi).
+// The in-memory tree shadows segments; newer segments shadow older ones, and
+// a tombstone hides every older copy of its key.
+//
+// mem is read as the scan advances, so nothing may write to it until Close:
+// pass a tree no one writes to any more, or a Clone taken on the goroutine
+// that does the writing. Callers must Close the iterator to release segment
+// files.
+func (c *CatalogOf[K]) Scan(mem *btree.BTreeOf[K], lo, hi K) *ScanIterOf[K] {
+	return c.ScanTrees([]*btree.BTreeOf[K]{mem}, lo, hi)
+}
+
+// ScanTrees is Scan over several in-memory trees, newest first: the tree
+// being filled, then one a background flush is still writing out. Each
+// shadows the ones after it and every segment; nil trees are skipped.
+func (c *CatalogOf[K]) ScanTrees(mems []*btree.BTreeOf[K], lo, hi K) *ScanIterOf[K] {
+	s := &ScanIterOf[K]{}
+	if hi <= lo {
+		return s
+	}
+
+	for _, mem := range mems {
+		if mem != nil {
+			s.sources = append(s.sources, &treeSource[K]{it: mem.IterFrom(lo), hi: hi})
+		}
+	}
+
+	var overlapping []SegmentFileOf[K]
+	for _, seg := range c.segments {
+		if seg.MinPK >= hi {
+			break
+		}
+		if seg.MaxPK >= lo {
+			overlapping = append(overlapping, seg)
+		}
+	}
+	sortNewestFirst(overlapping)
+	for _, seg := range overlapping {
+		s.sources = append(s.sources, &fileSource[K]{path: seg.Path, lo: lo, hi: hi})
+	}
+
+	s.start()
+	return s
+}
+
+// start primes the heap with the first item of every source.
+func (s *ScanIterOf[K]) start() {
+	for rank, src := range s.sources {
+		if !s.push(rank, src) {
+			return
+		}
+	}
+}
+
+// Next returns the next visible item. ok=false when the scan is finished or
+// failed; check Err afterwards.
+func (s *ScanIterOf[K]) Next() (item btree.ItemOf[K], ok bool) {
+	for s.err == nil && len(s.h) > 0 {
+		top := heap.Pop(&s.h).(mergeEntry[K])
+		if !s.push(top.rank, s.sources[top.rank]) {
+			return btree.ItemOf[K]{}, false
+		}
+
+		// Drop older copies of the same PK.
+		for len(s.h) > 0 && s.h[0].item.PK == top.item.PK {
+			dup := heap.Pop(&s.h).(mergeEntry[K])
+			if !s.push(dup.rank, s.sources[dup.rank]) {
+				return btree.ItemOf[K]{}, false
+			}
+		}
+
+		if top.item.Deleted && !s.tombstones {
+			continue
+		}
+		return top.item, true
+	}
+	return btree.ItemOf[K]{}, false
+}
+
+func (s *ScanIterOf[K]) Err() error {
+	return s.err
+}
+
+// Close releases all open segment files.
+func (s *ScanIterOf[K]) Close() error {
+	var firstErr error
+	for _, src := range s.sources {
+		if err := src.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.h = nil
+	return firstErr
+}
+
+// push advances src and adds its next item to the heap. Returns false on error.
+func (s *ScanIterOf[K]) push(rank int, src source[K]) bool {
+	item, ok, err := src.next()
+	if err != nil {
+		s.err = err
+		return false
+	}
+	if ok {
+		heap.Push(&s.h, mergeEntry[K]{item: item, rank: rank})
+	}
+	return true
+}
+
+type mergeEntry[K btreeWriting.Key] struct {
+	item btree.ItemOf[K]
+	rank int
+}
+
+type mergeHeap[K btreeWriting.Key] []mergeEntry[K]
+
+func (h mergeHeap[K]) Len() int { return len(h) }
+func (h mergeHeap[K]) Less(i, j int) bool {
+	if h[i].item.PK != h[j].item.PK {
+		return h[i].item.PK < h[j].item.PK
+	}
+	return h[i].rank < h[j].rank
+}
+func (h mergeHeap[K]) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap[K]) Push(x any)   { *h = append(*h, x.(mergeEntry[K])) }
+func (h *mergeHeap[K]) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// treeSource streams a tree snapshot's items with PK < hi, starting from an
+// iterator already positioned at lo.
+type treeSource[K btreeWriting.Key] struct {
+	it *btree.IterOf[K]
+	hi K
+}
+
+func (s *treeSource[K]) next() (btree.ItemOf[K], bool, error) {
+	it, ok := s.it.Next()
+	if !ok || it.PK >= s.hi {
+		return btree.ItemOf[K]{}, false, nil
+	}
+	return it, true, nil
+}
+
+func (s *treeSource[K]) close() error { return nil }
+
+// fileSource streams the records of one segment file with lo <= PK < hi
+// (PK <= hi if hiInclusive), starting at the index block holding lo.
+type fileSource[K btreeWriting.Key] struct {
+	path        string
+	lo, hi      K
+	hiInclusive bool
+
+	seg  *btreeWriting.SegmentOf[K]
+	r    *btreeWriting.ReaderOf[K]
+	done bool
+}
+
+func (s *fileSource[K]) next() (btree.ItemOf[K], bool, error) {
+	if s.done {
+		return btree.ItemOf[K]{}, false, nil
+	}
+	if s.seg == nil {
+		seg, err := btreeWriting.OpenSegmentOf[K](s.path)
+		if err != nil {
+			return btree.ItemOf[K]{}, false, err
+		}
+		s.seg = seg
+		s.r = seg.ReaderFrom(s.lo, segmentReadBufferSize)
+	}
+
+	for {
+		it, err := s.r.Next()
+		if errors.Is(err, io.EOF) {
+			s.done = true
+			return btree.ItemOf[K]{}, false, nil
+		}
+		if err != nil {
+			return btree.ItemOf[K]{}, false, err
+		}
+		if it.PK < s.lo {
+			continue
+		}
+		if it.PK > s.hi || (it.PK == s.hi && !s.hiInclusive) {
+			s.done = true
+			// verify the block holding the rows already yielded
+			if err := s.r.FinishBlock(); err != nil {
+				return btree.ItemOf[K]{}, false, err
+			}
+			return btree.ItemOf[K]{}, false, nil
+		}
+		return it, true, nil
+	}
+}
+
+func (s *fileSource[K]) close() error {
+	s.done = true
+	if s.seg == nil {
+		return nil
+	}
+	err := s.seg.Close()
+	s.seg = nil
+	return err
+}
@@ -0,0 +1,105 @@
+package segmentStore
+
+import (
+	"SpeedyDb/btree"
+	"fmt"
+	"testing"
+)
+
+// scanAll runs a scan and renders each item as "pk=v".
+func scanAll(t *testing.T, c *Catalog, mem *btree.BTree, lo, hi int64) []string {
+	t.Helper()
+	it := c.Scan(mem, lo, hi)
+	defer it.Close()
+	var got []string
+	for {
+		item, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, fmt.Sprintf("%d=%v", item.PK, item.Row["v"]))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestScanMerge(t *testing.T) {
+	dir := t.TempDir()
+	old := writeSegment(t, dir, SegmentName[int64](0, 20, 1), evens(0, 20, "old"))
+	newer := writeSegment(t, dir, SegmentName[int64](6, 12, 2), []btree.Item{
+		{PK: 6, Row: btree.Row{"v": "new"}},
+		{PK: 8, Deleted: true},
+		{PK: 11, Row: btree.Row{"v": "new"}},
+		{PK: 12, Row: btree.Row{"v": "new"}},
+	})
+	c, err := NewCatalog([]string{old, newer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := btree.New(2)
+	mem.Upsert(btree.Item{PK: 1, Row: btree.Row{"v": "mem"}})
+	mem.Upsert(btree.Item{PK: 4, Deleted: true})
+	mem.Upsert(btree.Item{PK: 12, Row: btree.Row{"v": "mem"}})
+	mem.Upsert(btree.Item{PK: 30, Row: btree.Row{"v": "mem"}})
+
+	tests := []struct {
+		lo, hi int64
+		want   string
+	}{
+		{0, 100, "[0=old 1=mem 2=old 6=new 10=old 11=new 12=mem 14=old 16=old 18=old 20=old 30=mem]"},
+		{2, 12, "[2=old 6=new 10=old 11=new]"},
+		{3, 5, "[]"},
+		{7, 9, "[]"},
+		{12, 13, "[12=mem]"},
+		{21, 30, "[]"},
+		{10, 10, "[]"},
+		{10, 5, "[]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(scanAll(t, c, mem, tt.lo, tt.hi)); got != tt.want {
+			t.Errorf("Scan(%d, %d) = %s, want %s", tt.lo, tt.hi, got, tt.want)
+		}
+	}
+
+	if got, want := fmt.Sprint(scanAll(t, c, nil, 0, 9)), "[0=old 2=old 4=old 6=new]"; got != want {
+		t.Errorf("Scan without a tree = %s, want %s", got, want)
+	}
+}
+
+func TestScanTrees(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCatalog([]string{writeSegment(t, dir, SegmentName[int64](0, 8, 1), evens(0, 8, "disk"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flushing := btree.New(2)
+	flushing.Upsert(btree.Item{PK: 2, Row: btree.Row{"v": "flushing"}})
+	flushing.Upsert(btree.Item{PK: 3, Row: btree.Row{"v": "flushing"}})
+	flushing.Upsert(btree.Item{PK: 4, Deleted: true})
+	flushing.Upsert(btree.Item{PK: 5, Row: btree.Row{"v": "flushing"}})
+	live := btree.New(2)
+	live.Upsert(btree.Item{PK: 3, Row: btree.Row{"v": "live"}})
+	live.Upsert(btree.Item{PK: 5, Deleted: true})
+	live.Upsert(btree.Item{PK: 6, Row: btree.Row{"v": "live"}})
+
+	it := c.ScanTrees([]*btree.BTree{live, nil, flushing}, 0, 100)
+	defer it.Close()
+	var got []string
+	for {
+		item, ok := it.Next()
+		if !ok {
+			break
+		}
+		got = append(got, fmt.Sprintf("%d=%v", item.PK, item.Row["v"]))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[0=disk 2=flushing 3=live 6=live 8=disk]"; fmt.Sprint(got) != want {
+		t.Fatalf("ScanTrees = %v, want %s", got, want)
+	}
+}
@@ -308,13 +308,39 @@ ORDER BY ordinal_position;
 	return out, orderSlice, rows.Err()
 }
 
-func GetRowSizeSQL(user, password, host, port, schema, table string) (rowSizeBytes uint64, colSizes map[string]int, orderSlice []string, err error) {
+// PrimaryKeyColumns returns the table's primary key columns in key order, or
+// nil if it has no primary key.
+func PrimaryKeyColumns(db *sql.DB, schema, table string) ([]string, error) {
+	q := `
+SELECT column_name
+FROM information_schema.key_column_usage
+WHERE table_schema=? AND table_name=? AND constraint_name='PRIMARY'
+ORDER BY ordinal_position;
+`
+	rows, err := db.Query(q, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cols []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	return cols, rows.Err()
+}
+
+func GetRowSizeSQL(user, password, host, port, schema, table string) (rowSizeBytes uint64, colSizes map[string]int, orderSlice []string, pkColumns []string, err error) {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/information_schema?parseTime=true", user, password, host, port)
 	fmt.Println(dsn)
 
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		return 0, nil, nil, err
+		return 0, nil, nil, nil, err
 	}
 	defer db.Close()
 
@@ -322,7 +348,12 @@ func GetRowSizeSQL(user, password, host, port, schema, table string) (rowSizeByt
 
 	m, o, err := ColumnSizeMap(db, schema, table, ignoreJSON)
 	if err != nil {
-		return 0, nil, nil, err
+		return 0, nil, nil, nil, err
+	}
+
+	pk, err := PrimaryKeyColumns(db, schema, table)
+	if err != nil {
+		return 0, nil, nil, nil, err
 	}
 
 	var total uint64
@@ -330,5 +361,5 @@ func GetRowSizeSQL(user, password, host, port, schema, table string) (rowSizeByt
 		total += uint64(sz)
 	}
 
-	return total, m, o, nil
+	return total, m, o, pk, nil
 }